@@ -0,0 +1,153 @@
+package model
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/SyntropyDev/httperr"
+	"github.com/SyntropyDev/milli"
+	"github.com/SyntropyDev/sqlutil"
+	"github.com/SyntropyDev/val"
+	"github.com/coopernurse/gorp"
+	"github.com/dchest/uniuri"
+	"github.com/lann/squirrel"
+)
+
+const (
+	ObjectNameAPIKey = "APIKey"
+	TableNameAPIKey  = "api_keys"
+)
+
+// Scopes an api key can be granted.
+const (
+	ScopeStoriesRead     = "stories:read"
+	ScopeStoriesWrite    = "stories:write"
+	ScopeMembersRead     = "members:read"
+	ScopeMembersWrite    = "members:write"
+	ScopeFeedsRead       = "feeds:read"
+	ScopeFeedsWrite      = "feeds:write"
+	ScopeCategoriesRead  = "categories:read"
+	ScopeCategoriesWrite = "categories:write"
+)
+
+// APIKey lets kiosks and partner sites call the api without a member
+// logging in.  Like tokens only a keyed hash of the key is stored.
+type APIKey struct {
+	ID      int64  `json:"id" filter:"true"`
+	Created int64  `json:"created" val:"nonzero" filter:"true"`
+	Updated int64  `json:"updated" val:"nonzero" filter:"true"`
+	Deleted bool   `json:"deleted" filter:"true"`
+	Object  string `db:"-" json:"object"`
+
+	Name       string   `json:"name" val:"nonzero" filter:"true"`
+	MemberID   int64    `json:"memberId" val:"nonzero" filter:"true"`
+	Key        string   `db:"-" json:"key,omitempty"`
+	Hash       string   `json:"-" val:"nonzero" audit:"secret"`
+	ScopesRaw  string   `json:"-"`
+	Expiration int64    `json:"expirationTimestamp" filter:"true"`
+	Scopes     []string `db:"-" json:"scopes"`
+}
+
+func Scopes() []string {
+	return []string{ScopeStoriesRead, ScopeStoriesWrite, ScopeMembersRead,
+		ScopeMembersWrite, ScopeFeedsRead, ScopeFeedsWrite,
+		ScopeCategoriesRead, ScopeCategoriesWrite}
+}
+
+// FindAPIKey returns the unrevoked, unexpired api key with the given value.
+func FindAPIKey(s gorp.SqlExecutor, key string) (*APIKey, error) {
+	query := squirrel.Select("*").From(TableNameAPIKey).
+		Where(squirrel.Eq{"Hash": hashToken(key), "Deleted": false})
+	keys := []*APIKey{}
+	sqlutil.Select(s, query, &keys)
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("api key not found")
+	}
+	if keys[0].IsExpired() {
+		return nil, fmt.Errorf("api key expired")
+	}
+	return keys[0], nil
+}
+
+// RevokeMemberAPIKeys revokes every api key belonging to memberID.
+func RevokeMemberAPIKeys(s gorp.SqlExecutor, memberID int64) error {
+	format := "update " + TableNameAPIKey + " set Deleted = ?, Updated = ? where MemberID = ? and Deleted = ?"
+	_, err := s.Exec(format, true, milli.Timestamp(time.Now()), memberID, false)
+	return err
+}
+
+// HasScope returns true if the key was granted scope.
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.ScopesSlice() {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// IsExpired returns true if the key has an expiration and it has passed.
+func (k *APIKey) IsExpired() bool {
+	if k.Expiration == 0 {
+		return false
+	}
+	return time.Now().After(milli.Time(k.Expiration))
+}
+
+func (k *APIKey) ScopesSlice() []string {
+	return sliceFromString(k.ScopesRaw)
+}
+
+func (k *APIKey) Validate() error {
+	if valid, errMap := val.Struct(k); !valid {
+		return ErrorFromMap(k, errMap)
+	}
+	known := Scopes()
+	for _, scope := range k.ScopesSlice() {
+		found := false
+		for _, s := range known {
+			found = found || s == scope
+		}
+		if !found {
+			err := fmt.Errorf("unknown scope %s", scope)
+			return httperr.New(http.StatusBadRequest, err.Error(), err)
+		}
+	}
+	return nil
+}
+
+func (k *APIKey) PreInsert(s gorp.SqlExecutor) error {
+	k.Created = milli.Timestamp(time.Now())
+	k.Updated = milli.Timestamp(time.Now())
+	k.Key = uniuri.NewLen(40)
+	k.Hash = hashToken(k.Key)
+	k.ScopesRaw = strings.Join(k.Scopes, ",")
+	return k.Validate()
+}
+
+func (k *APIKey) PreUpdate(s gorp.SqlExecutor) error {
+	k.Updated = milli.Timestamp(time.Now())
+	return k.Validate()
+}
+
+func (k *APIKey) PostGet(s gorp.SqlExecutor) error {
+	k.Object = ObjectNameAPIKey
+	k.Scopes = k.ScopesSlice()
+	return nil
+}
+
+// CrudResource interface
+
+func (k *APIKey) TableName() string {
+	return TableNameAPIKey
+}
+
+func (k *APIKey) TableId() int64 {
+	return k.ID
+}
+
+func (k *APIKey) Delete() {
+	k.Deleted = true
+}
@@ -0,0 +1,198 @@
+package model
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/SyntropyDev/milli"
+	"github.com/SyntropyDev/val"
+	"github.com/coopernurse/gorp"
+)
+
+const (
+	ObjectNameAuditEvent = "AuditEvent"
+	TableNameAuditEvent  = "audit_events"
+
+	ActorTypeMember = "member"
+	ActorTypeAPIKey = "apiKey"
+
+	AuditActionCreate  = "create"
+	AuditActionUpdate  = "update"
+	AuditActionDelete  = "delete"
+	AuditActionRestore = "restore"
+	AuditActionApprove = "approve"
+	AuditActionReject  = "reject"
+	AuditActionUnlock  = "unlock"
+	AuditActionInvite  = "invite"
+
+	AuditActionChangePassword = "changePassword"
+	AuditActionResetPassword  = "resetPassword"
+	AuditActionRefresh        = "refresh"
+	AuditActionRevoke         = "revoke"
+	AuditActionLink           = "link"
+	AuditActionEnableTOTP     = "enableTwoFactor"
+	AuditActionDisableTOTP    = "disableTwoFactor"
+)
+
+// AuditEvent records who changed a resource and how.  Before and After only
+// hold the json fields that changed.
+type AuditEvent struct {
+	ID      int64  `json:"id" filter:"true"`
+	Created int64  `json:"created" val:"nonzero" filter:"true"`
+	Updated int64  `json:"updated" val:"nonzero" filter:"true"`
+	Deleted bool   `json:"deleted" filter:"true"`
+	Object  string `db:"-" json:"object"`
+
+	ActorType     string          `json:"actorType" val:"in(member,apiKey)" filter:"true"`
+	ActorID       int64           `json:"actorId" val:"nonzero" filter:"true"`
+	Action        string          `json:"action" val:"nonzero" filter:"true"`
+	ResourceTable string          `json:"resourceTable" val:"nonzero" filter:"true"`
+	ResourceID    int64           `json:"resourceId" filter:"true"`
+	BeforeRaw     string          `json:"-"`
+	AfterRaw      string          `json:"-"`
+	Before        json.RawMessage `db:"-" json:"before"`
+	After         json.RawMessage `db:"-" json:"after"`
+}
+
+// NewAuditEvent records action on a resource by an actor.  before and after
+// are the resource before and after the change, either may be nil.
+func NewAuditEvent(actorType string, actorID int64, action, table string, id int64, before, after interface{}) (*AuditEvent, error) {
+	beforeMap, err := Snapshot(before)
+	if err != nil {
+		return nil, err
+	}
+	afterMap, err := Snapshot(after)
+	if err != nil {
+		return nil, err
+	}
+
+	// keep only what changed, ignoring bookkeeping fields and never
+	// recording secrets that are only set in responses
+	for _, key := range []string{"updated", "object", "password", "token", "key", "value", "recoveryCodes"} {
+		delete(beforeMap, key)
+		delete(afterMap, key)
+	}
+	for key, value := range beforeMap {
+		if other, ok := afterMap[key]; ok && reflect.DeepEqual(value, other) {
+			delete(beforeMap, key)
+			delete(afterMap, key)
+		}
+	}
+
+	beforeRaw, err := json.Marshal(beforeMap)
+	if err != nil {
+		return nil, err
+	}
+	afterRaw, err := json.Marshal(afterMap)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditEvent{
+		ActorType:     actorType,
+		ActorID:       actorID,
+		Action:        action,
+		ResourceTable: table,
+		ResourceID:    id,
+		BeforeRaw:     string(beforeRaw),
+		AfterRaw:      string(afterRaw),
+	}, nil
+}
+
+// Snapshot returns the json object for v, or an empty map if v is nil, so
+// it can be compared with v after it changes.  The columns json leaves out,
+// like a member's organizer flag, are added by field name, with those
+// tagged audit:"secret" redacted.
+func Snapshot(v interface{}) (map[string]interface{}, error) {
+	m := map[string]interface{}{}
+	if v == nil {
+		return m, nil
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Ptr, reflect.Map:
+		if rv.IsNil() {
+			return m, nil
+		}
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+
+	rv = reflect.Indirect(rv)
+	if rv.Kind() != reflect.Struct {
+		return m, nil
+	}
+	objT := rv.Type()
+	for i := 0; i < objT.NumField(); i++ {
+		field := objT.Field(i)
+		if field.PkgPath != "" || field.Tag.Get("db") == "-" ||
+			strings.Split(field.Tag.Get("json"), ",")[0] != "-" {
+			continue
+		}
+		value := rv.Field(i).Interface()
+		if field.Tag.Get("audit") == "secret" {
+			value = redacted(value)
+		}
+		m[field.Name] = value
+	}
+	return m, nil
+}
+
+// redacted stands in for a secret in a snapshot.  It changes when the
+// secret does, so the change is still recorded, without revealing it.
+func redacted(v interface{}) string {
+	s := fmt.Sprint(v)
+	if s == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(s))
+	return "redacted:" + hex.EncodeToString(sum[:4])
+}
+
+func (e *AuditEvent) Validate() error {
+	if valid, errMap := val.Struct(e); !valid {
+		return ErrorFromMap(e, errMap)
+	}
+	return nil
+}
+
+func (e *AuditEvent) PreInsert(s gorp.SqlExecutor) error {
+	e.Created = milli.Timestamp(time.Now())
+	e.Updated = milli.Timestamp(time.Now())
+	return e.Validate()
+}
+
+func (e *AuditEvent) PreUpdate(s gorp.SqlExecutor) error {
+	e.Updated = milli.Timestamp(time.Now())
+	return e.Validate()
+}
+
+func (e *AuditEvent) PostGet(s gorp.SqlExecutor) error {
+	e.Object = ObjectNameAuditEvent
+	e.Before = json.RawMessage(e.BeforeRaw)
+	e.After = json.RawMessage(e.AfterRaw)
+	return nil
+}
+
+// CrudResource interface
+
+func (e *AuditEvent) TableName() string {
+	return TableNameAuditEvent
+}
+
+func (e *AuditEvent) TableId() int64 {
+	return e.ID
+}
+
+func (e *AuditEvent) Delete() {
+	e.Deleted = true
+}
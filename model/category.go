@@ -1,9 +1,6 @@
 package model
 
 import (
-	"errors"
-	"fmt"
-	"strings"
 	"time"
 
 	"github.com/SyntropyDev/milli"
@@ -17,18 +14,18 @@ const (
 )
 
 type Category struct {
-	ID      int64  `json:"id"`
-	Created int64  `json:"created" val:"nonzero"`
-	Updated int64  `json:"updated" val:"nonzero"`
-	Deleted bool   `json:"deleted" merge:"true"`
+	ID      int64  `json:"id" filter:"true"`
+	Created int64  `json:"created" val:"nonzero" filter:"true"`
+	Updated int64  `json:"updated" val:"nonzero" filter:"true"`
+	Deleted bool   `json:"deleted" filter:"true"`
 	Object  string `db:"-" json:"object"`
 
-	Name string `json:"name" val:"nonzero" merge:"true"`
+	Name string `json:"name" val:"nonzero" merge:"true" filter:"true"`
 }
 
 func (c *Category) Validate() error {
 	if valid, errMap := val.Struct(c); !valid {
-		return ErrorFromMap(errMap)
+		return ErrorFromMap(c, errMap)
 	}
 	return nil
 }
@@ -63,11 +60,6 @@ func (c *Category) Delete() {
 	c.Deleted = true
 }
 
-func ErrorFromMap(errMap map[string]error) error {
-	errs := []string{}
-	for key, err := range errMap {
-		nErr := fmt.Sprintf("%s - %s", key, err)
-		errs = append(errs, nErr)
-	}
-	return errors.New(strings.Join(errs, ","))
+func (c *Category) Restore() {
+	c.Deleted = false
 }
@@ -32,6 +32,21 @@ type Community struct {
 	Latitude           float64   `json:"-" val:"lat"`
 	Longitude          float64   `json:"-" val:"lon"`
 	Location           []float64 `db:"-" json:"location" merge:"true"`
+
+	RequireOrganizerTwoFactor bool `json:"requireOrganizerTwoFactor" merge:"true"`
+}
+
+// FindCommunity returns the community the api serves.
+func FindCommunity(s gorp.SqlExecutor) (*Community, error) {
+	coms := []*Community{}
+	if _, err := s.Select(&coms, "select * from "+TableNameCommunity); err != nil {
+		return nil, err
+	}
+	if len(coms) == 0 {
+		err := errors.New("community not created")
+		return nil, httperr.New(http.StatusBadRequest, err.Error(), err)
+	}
+	return coms[0], nil
 }
 
 func (c *Community) Validate() error {
@@ -39,7 +54,7 @@ func (c *Community) Validate() error {
 		return err
 	}
 	if valid, errMap := val.Struct(c); !valid {
-		return ErrorFromMap(errMap)
+		return ErrorFromMap(c, errMap)
 	}
 	return nil
 }
@@ -0,0 +1,16 @@
+package model
+
+import (
+	"os"
+	"strconv"
+)
+
+// ConfigInt returns the integer config value for key, or d if it isn't set
+// or isn't a number.
+func ConfigInt(key string, d int) int {
+	i, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return d
+	}
+	return i
+}
@@ -0,0 +1,84 @@
+package model
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/SyntropyDev/val"
+)
+
+// FieldsError is an httperr.Error that also reports why each rejected
+// field was rejected, keyed by its json name so clients can point at the
+// bad input.
+type FieldsError struct {
+	Status int
+	M      string
+	Fields map[string]string
+}
+
+func NewFieldsError(status int, message string, fields map[string]string) *FieldsError {
+	return &FieldsError{
+		Status: status,
+		M:      message,
+		Fields: fields,
+	}
+}
+
+func (e *FieldsError) StatusCode() int {
+	return e.Status
+}
+
+func (e *FieldsError) Message() string {
+	return e.M
+}
+
+func (e *FieldsError) Error() string {
+	keys := []string{}
+	for key := range e.Fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	errs := []string{}
+	for _, key := range keys {
+		errs = append(errs, fmt.Sprintf("%s - %s", key, e.Fields[key]))
+	}
+	return e.M + " " + strings.Join(errs, ",")
+}
+
+// ErrorFromMap returns the failures val.Struct found in m as a
+// FieldsError.
+func ErrorFromMap(m interface{}, errMap map[string]error) error {
+	message := fmt.Sprintf("%s did not pass validation.", reflect.Indirect(reflect.ValueOf(m)).Type().Name())
+	return NewFieldsError(http.StatusBadRequest, message, jsonFields(m, errMap))
+}
+
+// ValidationFields runs m's val tags and returns the failures keyed by
+// json name, or nil if m is valid.
+func ValidationFields(m interface{}) map[string]string {
+	valid, errMap := val.Struct(m)
+	if valid {
+		return nil
+	}
+	return jsonFields(m, errMap)
+}
+
+// jsonFields rekeys errMap from m's field names to their json names.
+// Fields without one keep their field name.
+func jsonFields(m interface{}, errMap map[string]error) map[string]string {
+	objT := reflect.Indirect(reflect.ValueOf(m)).Type()
+	fields := map[string]string{}
+	for name, err := range errMap {
+		key := name
+		if field, ok := objT.FieldByName(name); ok {
+			tag := strings.Split(field.Tag.Get("json"), ",")[0]
+			if tag != "-" && tag != "" {
+				key = tag
+			}
+		}
+		fields[key] = err.Error()
+	}
+	return fields
+}
@@ -0,0 +1,236 @@
+package model
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/SyntropyDev/httperr"
+	"github.com/SyntropyDev/sqlutil"
+	"github.com/coopernurse/gorp"
+	"github.com/lann/squirrel"
+)
+
+const (
+	ExpandMember = "member"
+	ExpandFeed   = "feed"
+	ExpandFeeds  = "feeds"
+)
+
+// memberRow has Member's columns but none of its hooks, so members can be
+// selected without Member.PostGet querying categories once per row.
+type memberRow Member
+
+// Expand embeds the named relations in items, which must all be the same
+// type.  Each relation is loaded with a fixed number of queries for the
+// whole slice, rather than one per item.  Stories always get the icon and
+// categories of their member.
+func Expand(s gorp.SqlExecutor, items []interface{}, relations []string) error {
+	if len(items) == 0 {
+		return nil
+	}
+
+	switch items[0].(type) {
+	case *Story:
+		stories := make([]*Story, len(items))
+		for i, item := range items {
+			stories[i] = item.(*Story)
+		}
+		return expandStories(s, stories, relations)
+	case *Member:
+		members := make([]*Member, len(items))
+		for i, item := range items {
+			members[i] = item.(*Member)
+		}
+		return expandMembers(s, members, relations)
+	case *Feed:
+		feeds := make([]*Feed, len(items))
+		for i, item := range items {
+			feeds[i] = item.(*Feed)
+		}
+		return expandFeeds(s, feeds, relations)
+	}
+
+	if len(relations) > 0 {
+		return errExpand(relations[0])
+	}
+	return nil
+}
+
+func expandStories(s gorp.SqlExecutor, stories []*Story, relations []string) error {
+	expandMember, expandFeed := false, false
+	for _, rel := range relations {
+		switch rel {
+		case ExpandMember:
+			expandMember = true
+		case ExpandFeed:
+			expandFeed = true
+		default:
+			return errExpand(rel)
+		}
+	}
+
+	memberIDs, feedIDs := []int64{}, []int64{}
+	for _, story := range stories {
+		memberIDs = append(memberIDs, story.MemberID)
+		feedIDs = append(feedIDs, story.FeedID)
+	}
+
+	members, err := loadMembers(s, memberIDs)
+	if err != nil {
+		return err
+	}
+	feeds := map[int64]*Feed{}
+	if expandFeed {
+		if feeds, err = loadFeeds(s, feedIDs); err != nil {
+			return err
+		}
+	}
+
+	for _, story := range stories {
+		story.MemberIcon, story.CategoryIds = "", []int64{}
+		if m, ok := members[story.MemberID]; ok {
+			story.MemberIcon = m.Icon
+			story.CategoryIds = m.CategoryIds
+			if expandMember {
+				story.Member = m
+			}
+		}
+		if expandFeed {
+			story.Feed = feeds[story.FeedID]
+		}
+	}
+	return nil
+}
+
+func expandMembers(s gorp.SqlExecutor, members []*Member, relations []string) error {
+	for _, rel := range relations {
+		if rel != ExpandFeeds && rel != ExpandFeed {
+			return errExpand(rel)
+		}
+
+		ids := []int64{}
+		for _, m := range members {
+			ids = append(ids, m.ID)
+		}
+		query := squirrel.Select("*").From(TableNameFeed).
+			Where(squirrel.Eq{"MemberID": ids, "Deleted": false})
+		feeds := []*Feed{}
+		if err := sqlutil.Select(s, query, &feeds); err != nil {
+			return err
+		}
+
+		byMember := map[int64][]*Feed{}
+		for _, f := range feeds {
+			byMember[f.MemberID] = append(byMember[f.MemberID], f)
+		}
+		for _, m := range members {
+			m.Feeds = byMember[m.ID]
+			if m.Feeds == nil {
+				m.Feeds = []*Feed{}
+			}
+		}
+	}
+	return nil
+}
+
+func expandFeeds(s gorp.SqlExecutor, feeds []*Feed, relations []string) error {
+	for _, rel := range relations {
+		if rel != ExpandMember {
+			return errExpand(rel)
+		}
+
+		ids := []int64{}
+		for _, f := range feeds {
+			ids = append(ids, f.MemberID)
+		}
+		members, err := loadMembers(s, ids)
+		if err != nil {
+			return err
+		}
+		for _, f := range feeds {
+			f.Member = members[f.MemberID]
+		}
+	}
+	return nil
+}
+
+// loadMembers returns the members with ids that haven't been deleted,
+// including their categories, in two queries.
+func loadMembers(s gorp.SqlExecutor, ids []int64) (map[int64]*Member, error) {
+	members := map[int64]*Member{}
+	if len(ids) == 0 {
+		return members, nil
+	}
+
+	query := squirrel.Select("*").From(TableNameMember).
+		Where(squirrel.Eq{"ID": ids, "Deleted": false})
+	list, err := selectMembers(s, query)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range list {
+		members[m.ID] = m
+	}
+	return members, nil
+}
+
+// selectMembers runs query, which must select every member column, and
+// loads the categories of all the members it returns in one more query.
+func selectMembers(s gorp.SqlExecutor, query squirrel.SelectBuilder) ([]*Member, error) {
+	rows := []*memberRow{}
+	if err := sqlutil.Select(s, query, &rows); err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return []*Member{}, nil
+	}
+
+	members := make([]*Member, len(rows))
+	byID := map[int64]*Member{}
+	ids := []int64{}
+	for i, row := range rows {
+		m := (*Member)(row)
+		m.fillDerived()
+		m.CategoryIds = []int64{}
+		members[i] = m
+		byID[m.ID] = m
+		ids = append(ids, m.ID)
+	}
+
+	catMems := []*CategoryMember{}
+	catQuery := squirrel.Select("*").From(TableNameCategoryMember).
+		Where(squirrel.Eq{"MemberID": ids})
+	if err := sqlutil.Select(s, catQuery, &catMems); err != nil {
+		return nil, err
+	}
+	for _, catMem := range catMems {
+		if m, ok := byID[catMem.MemberID]; ok {
+			m.CategoryIds = append(m.CategoryIds, catMem.CategoryID)
+		}
+	}
+	return members, nil
+}
+
+// loadFeeds returns the feeds with ids that haven't been deleted.
+func loadFeeds(s gorp.SqlExecutor, ids []int64) (map[int64]*Feed, error) {
+	feeds := map[int64]*Feed{}
+	if len(ids) == 0 {
+		return feeds, nil
+	}
+
+	rows := []*Feed{}
+	query := squirrel.Select("*").From(TableNameFeed).
+		Where(squirrel.Eq{"ID": ids, "Deleted": false})
+	if err := sqlutil.Select(s, query, &rows); err != nil {
+		return nil, err
+	}
+	for _, f := range rows {
+		feeds[f.ID] = f
+	}
+	return feeds, nil
+}
+
+func errExpand(relation string) error {
+	err := fmt.Errorf("can't expand %s", relation)
+	return httperr.New(http.StatusBadRequest, err.Error(), err)
+}
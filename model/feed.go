@@ -27,22 +27,28 @@ type fbookUser struct {
 }
 
 type Feed struct {
-	ID      int64  `json:"id"`
-	Created int64  `json:"created" val:"nonzero"`
-	Updated int64  `json:"updated" val:"nonzero"`
-	Deleted bool   `json:"deleted" merge:"true"`
+	ID      int64  `json:"id" filter:"true"`
+	Created int64  `json:"created" val:"nonzero" filter:"true"`
+	Updated int64  `json:"updated" val:"nonzero" filter:"true"`
+	Deleted bool   `json:"deleted" filter:"true"`
 	Object  string `db:"-" json:"object"`
 
-	MemberID      int64  `json:"memberId" val:"nonzero" merge:"true"`
-	Type          string `json:"type" val:"in(twitter,facebook,rss)" merge:"true"`
-	Identifier    string `json:"identifier" val:"nonzero" merge:"true"`
+	MemberID      int64  `json:"memberId" val:"nonzero" merge:"true" filter:"true"`
+	Type          string `json:"type" val:"in(twitter,facebook,rss)" merge:"true" filter:"true"`
+	Identifier    string `json:"identifier" val:"nonzero" merge:"true" filter:"true"`
 	LastRetrieved int64  `json:"-"`
+
+	// embedded with q-expand
+	Member *Member `db:"-" json:"member,omitempty"`
 }
 
+// ListenToFeeds fetches new stories for every feed, skipping deleted feeds
+// and the feeds of deleted members.
 func ListenToFeeds(s gorp.SqlExecutor) error {
 	feeds := []*Feed{}
-	query := squirrel.Select("*").From(TableNameFeed).
-		Where(squirrel.Eq{"Deleted": false})
+	query := squirrel.Select(TableNameFeed+".*").From(TableNameFeed).
+		Join(TableNameMember+" ON "+TableNameMember+".ID = "+TableNameFeed+".MemberID").
+		Where(TableNameFeed+".Deleted = ? AND "+TableNameMember+".Deleted = ?", false, false)
 	if err := sqlutil.Select(s, query, &feeds); err != nil {
 		return err
 	}
@@ -64,7 +70,7 @@ func (f *Feed) UpdateStories(s gorp.SqlExecutor) error {
 
 func (f *Feed) Validate() error {
 	if valid, errMap := val.Struct(f); !valid {
-		return ErrorFromMap(errMap)
+		return ErrorFromMap(f, errMap)
 	}
 	return nil
 }
@@ -136,3 +142,13 @@ func (f *Feed) TableId() int64 {
 func (f *Feed) Delete() {
 	f.Deleted = true
 }
+
+func (f *Feed) Restore() {
+	f.Deleted = false
+}
+
+// Owned interface
+
+func (f *Feed) OwnerID() int64 {
+	return f.MemberID
+}
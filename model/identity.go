@@ -0,0 +1,153 @@
+package model
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/SyntropyDev/httperr"
+	"github.com/SyntropyDev/milli"
+	"github.com/SyntropyDev/sqlutil"
+	"github.com/SyntropyDev/val"
+	"github.com/coopernurse/gorp"
+	"github.com/lann/squirrel"
+)
+
+const (
+	ObjectNameIdentity = "Identity"
+	TableNameIdentity  = "identities"
+)
+
+// Identity links a member to an account with an OAuth provider so they can
+// log in with it instead of a password.
+type Identity struct {
+	ID      int64  `json:"id"`
+	Created int64  `json:"created" val:"nonzero"`
+	Updated int64  `json:"updated" val:"nonzero"`
+	Deleted bool   `json:"deleted"`
+	Object  string `db:"-" json:"object"`
+
+	MemberID   int64  `json:"memberId" val:"nonzero"`
+	Provider   string `json:"provider" val:"in(twitter,facebook)"`
+	ProviderID string `json:"providerId" val:"nonzero"`
+	Handle     string `json:"handle"`
+}
+
+// FindIdentityMember returns the member linked to account.
+func FindIdentityMember(s gorp.SqlExecutor, account *ExternalAccount) (*Member, error) {
+	identity, err := findIdentity(s, account)
+	if err != nil {
+		return nil, err
+	}
+	if identity == nil {
+		err := errors.New("no member is linked to this account")
+		return nil, httperr.New(http.StatusUnauthorized, err.Error(), err)
+	}
+
+	member := &Member{}
+	if err := sqlutil.SelectOneRelation(s, TableNameMember, identity.MemberID, member); err != nil {
+		return nil, err
+	}
+	if member.Deleted {
+		err := errors.New("no member is linked to this account")
+		return nil, httperr.New(http.StatusUnauthorized, err.Error(), err)
+	}
+	return member, nil
+}
+
+// LinkIdentity links account to member.  When createFeed is set the matching
+// feed is created too, unless it already exists, and returned.
+func LinkIdentity(s gorp.SqlExecutor, member *Member, account *ExternalAccount, createFeed bool) (*Identity, *Feed, error) {
+	identity, err := findIdentity(s, account)
+	if err != nil {
+		return nil, nil, err
+	}
+	if identity != nil && identity.MemberID != member.ID {
+		err := errors.New("account is linked to another member")
+		return nil, nil, httperr.New(http.StatusConflict, err.Error(), err)
+	}
+	if identity == nil {
+		identity = &Identity{
+			MemberID:   member.ID,
+			Provider:   string(account.Provider),
+			ProviderID: account.ID,
+			Handle:     account.Handle,
+		}
+		if err := s.Insert(identity); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if !createFeed {
+		return identity, nil, nil
+	}
+	query := squirrel.Select("*").From(TableNameFeed).
+		Where(squirrel.Eq{"Type": string(account.Provider), "Identifier": account.Handle})
+	feeds := []*Feed{}
+	if err := sqlutil.Select(s, query, &feeds); err != nil {
+		return nil, nil, err
+	}
+	if len(feeds) > 0 {
+		return identity, nil, nil
+	}
+	feed := &Feed{
+		MemberID:   member.ID,
+		Type:       string(account.Provider),
+		Identifier: account.Handle,
+	}
+	if err := s.Insert(feed); err != nil {
+		return nil, nil, err
+	}
+	return identity, feed, nil
+}
+
+// findIdentity returns the identity for account, or nil if it isn't linked.
+func findIdentity(s gorp.SqlExecutor, account *ExternalAccount) (*Identity, error) {
+	query := squirrel.Select("*").From(TableNameIdentity).
+		Where(squirrel.Eq{"Provider": string(account.Provider), "ProviderID": account.ID})
+	identities := []*Identity{}
+	if err := sqlutil.Select(s, query, &identities); err != nil {
+		return nil, err
+	}
+	if len(identities) == 0 {
+		return nil, nil
+	}
+	return identities[0], nil
+}
+
+func (i *Identity) Validate() error {
+	if valid, errMap := val.Struct(i); !valid {
+		return ErrorFromMap(i, errMap)
+	}
+	return nil
+}
+
+func (i *Identity) PreInsert(s gorp.SqlExecutor) error {
+	i.Created = milli.Timestamp(time.Now())
+	i.Updated = milli.Timestamp(time.Now())
+	return i.Validate()
+}
+
+func (i *Identity) PreUpdate(s gorp.SqlExecutor) error {
+	i.Updated = milli.Timestamp(time.Now())
+	return i.Validate()
+}
+
+func (i *Identity) PostGet(s gorp.SqlExecutor) error {
+	i.Object = ObjectNameIdentity
+	return nil
+}
+
+// CrudResource interface
+
+func (i *Identity) TableName() string {
+	return TableNameIdentity
+}
+
+func (i *Identity) TableId() int64 {
+	return i.ID
+}
+
+func (i *Identity) Delete() {
+	i.Deleted = true
+}
@@ -0,0 +1,142 @@
+package model
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/SyntropyDev/milli"
+	"github.com/coopernurse/gorp"
+)
+
+const (
+	loginBackoffThresholdEnv = "loginBackoffThreshold"
+	loginLockoutThresholdEnv = "loginLockoutThreshold"
+	loginLockoutMinutesEnv   = "loginLockoutMinutes"
+)
+
+// LoginDelayError is returned when a login is refused before the password is
+// checked.  Locked errors are 423 responses, backoff errors are 429s.  Both
+// tell the client when to retry.
+type LoginDelayError struct {
+	Code       int           `json:"statusCode"`
+	M          string        `json:"message"`
+	Err        string        `json:"error"`
+	RetryAfter time.Duration `json:"-"`
+}
+
+func newLoginDelayError(locked bool, retryAfter time.Duration) *LoginDelayError {
+	e := &LoginDelayError{
+		Code:       http.StatusTooManyRequests,
+		M:          "too many failed logins, try again later",
+		RetryAfter: retryAfter,
+	}
+	if locked {
+		e.Code = http.StatusLocked
+		e.M = "account locked after too many failed logins"
+	}
+	e.Err = fmt.Sprintf("%s (retry after %s)", e.M, retryAfter)
+	return e
+}
+
+func (e *LoginDelayError) StatusCode() int {
+	return e.Code
+}
+
+func (e *LoginDelayError) Message() string {
+	return e.M
+}
+
+func (e *LoginDelayError) Error() string {
+	return e.Err
+}
+
+// Backoff returns how long to wait after failures consecutive failed
+// logins.  There is no wait until threshold failures, then it doubles with
+// every failure up to an hour.
+func Backoff(failures, threshold int) time.Duration {
+	n := failures - threshold
+	if n < 0 {
+		return 0
+	}
+	secs := math.Min(math.Pow(2, float64(n)), 3600)
+	return time.Duration(secs) * time.Second
+}
+
+// UnlockMember clears the failed logins and lockout of the member with id.
+func UnlockMember(s gorp.SqlExecutor, id int64) error {
+	return setLoginFailures(s, id, 0, 0, 0)
+}
+
+// CheckLoginAllowed returns a LoginDelayError if the member is locked out or
+// must wait before trying again.
+func (m *Member) CheckLoginAllowed() error {
+	now := time.Now()
+	if locked := milli.Time(m.LockedUntil); now.Before(locked) {
+		return newLoginDelayError(true, locked.Sub(now))
+	}
+	backoff := Backoff(int(m.FailedLogins), ConfigInt(loginBackoffThresholdEnv, 3))
+	retry := milli.Time(m.LastFailedLogin).Add(backoff)
+	if now.Before(retry) {
+		return newLoginDelayError(false, retry.Sub(now))
+	}
+	return nil
+}
+
+// RecordFailedLogin counts a failed login, a wrong password or two factor
+// code, against the member, locking the account once the lockout threshold
+// is reached.  The count is kept by the database rather than written from
+// m, so parallel guesses can't overwrite each other's failures.
+func (m *Member) RecordFailedLogin(s gorp.SqlExecutor) error {
+	now := time.Now()
+	m.LastFailedLogin = milli.Timestamp(now)
+	format := "update " + TableNameMember +
+		" set FailedLogins = FailedLogins + 1, LastFailedLogin = ? where ID = ?"
+	if _, err := s.Exec(format, m.LastFailedLogin, m.ID); err != nil {
+		return err
+	}
+
+	// only one of the guesses that reach the threshold locks the account
+	lockout := time.Duration(ConfigInt(loginLockoutMinutesEnv, 15)) * time.Minute
+	lockedUntil := milli.Timestamp(now.Add(lockout))
+	format = "update " + TableNameMember +
+		" set FailedLogins = 0, LockedUntil = ? where ID = ? and FailedLogins >= ?"
+	res, err := s.Exec(format, lockedUntil, m.ID, ConfigInt(loginLockoutThresholdEnv, 10))
+	if err != nil {
+		return err
+	}
+	locked, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if locked > 0 {
+		m.FailedLogins, m.LockedUntil = 0, lockedUntil
+		return nil
+	}
+
+	failures, err := s.SelectInt("select FailedLogins from "+TableNameMember+" where ID = ?", m.ID)
+	if err != nil {
+		return err
+	}
+	m.FailedLogins = failures
+	return nil
+}
+
+// ResetFailedLogins clears the failed login count after a good login.
+func (m *Member) ResetFailedLogins(s gorp.SqlExecutor) error {
+	if m.FailedLogins == 0 && m.LockedUntil == 0 {
+		return nil
+	}
+	m.FailedLogins, m.LastFailedLogin, m.LockedUntil = 0, 0, 0
+	return setLoginFailures(s, m.ID, 0, 0, 0)
+}
+
+// setLoginFailures writes the login tracking columns directly so the rest of
+// the member, and its categories, aren't touched.
+func setLoginFailures(s gorp.SqlExecutor, id, failures, lastFailed, lockedUntil int64) error {
+	format := "update " + TableNameMember +
+		" set FailedLogins = ?, LastFailedLogin = ?, LockedUntil = ? where ID = ?"
+	_, err := s.Exec(format, failures, lastFailed, lockedUntil, id)
+	return err
+}
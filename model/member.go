@@ -25,30 +25,42 @@ const (
 	TableNameMember  = "members"
 
 	inviteEmailTemplate   = "You have been invited to Mobile Main Street!  Here is your temporary password: %s"
-	passwordResetTemplate = "Here is your temporary password: %s"
+	passwordResetTemplate = "Use this link to choose a new password.  It can only be used once and expires in an hour: %s"
 )
 
 type Member struct {
-	ID      int64  `json:"id"`
-	Created int64  `json:"created" val:"nonzero"`
-	Updated int64  `json:"updated" val:"nonzero"`
-	Deleted bool   `json:"deleted" merge:"true"`
+	ID      int64  `json:"id" filter:"true"`
+	Created int64  `json:"created" val:"nonzero" filter:"true"`
+	Updated int64  `json:"updated" val:"nonzero" filter:"true"`
+	Deleted bool   `json:"deleted" filter:"true"`
 	Object  string `db:"-" json:"object"`
 
 	// auth user
-	Email        string `json:"email" merge:"true"`
+	Email        string `json:"email" merge:"true" filter:"true"`
 	Organizer    bool   `json:"-"`
 	Token        string `db:"-" json:"token,omitempty"`
 	Password     string `db:"-" json:"password,omitempty"`
-	PasswordHash string `json:"-"`
+	PasswordHash string `json:"-" audit:"secret"`
+
+	// login throttling
+	FailedLogins    int64 `json:"-"`
+	LastFailedLogin int64 `json:"-"`
+	LockedUntil     int64 `json:"-"`
+
+	// two factor
+	TOTPSecret       string   `json:"-" audit:"secret"`
+	TOTPEnabled      bool     `json:"twoFactorEnabled"`
+	TOTPLastStep     int64    `json:"-"`
+	RecoveryCodesRaw string   `json:"-" audit:"secret"`
+	RecoveryCodes    []string `db:"-" json:"recoveryCodes,omitempty"`
 
 	// member
-	Name        string  `json:"name" val:"nonzero" merge:"true"`
-	Address     string  `json:"address" merge:"true"`
-	Phone       string  `json:"phone" merge:"true"`
-	Description string  `json:"description" merge:"true"`
+	Name        string  `json:"name" val:"nonzero" merge:"true" filter:"true"`
+	Address     string  `json:"address" merge:"true" filter:"true"`
+	Phone       string  `json:"phone" merge:"true" filter:"true"`
+	Description string  `json:"description" merge:"true" filter:"true"`
 	Icon        string  `json:"icon" merge:"true"`
-	Website     string  `json:"website" merge:"true"`
+	Website     string  `json:"website" merge:"true" filter:"true"`
 	Latitude    float64 `json:"-" merge:"true"`
 	Longitude   float64 `json:"-" merge:"true"`
 	ImagesRaw   string  `json:"-"`
@@ -58,11 +70,15 @@ type Member struct {
 	Images      []string  `db:"-" json:"images"`
 	Hashtags    []string  `db:"-" json:"hashTags"`
 	Location    []float64 `db:"-" json:"location"`
+
+	// embedded with q-expand
+	Feeds []*Feed `db:"-" json:"feeds,omitempty"`
 }
 
+// FindMember returns the member with email, unless it has been deleted.
 func FindMember(s gorp.SqlExecutor, email string) (*Member, error) {
 	query := squirrel.Select("*").From(TableNameMember).
-		Where(squirrel.Eq{"email": email})
+		Where(squirrel.Eq{"email": email, "Deleted": false})
 	members := []*Member{}
 	if err := sqlutil.Select(s, query, &members); err != nil {
 		return nil, err
@@ -81,24 +97,51 @@ func AuthenticateMember(s gorp.SqlExecutor, email, password string) (*Member, er
 	respErr := httperr.New(http.StatusUnauthorized, err.Error(), err)
 
 	member, err := FindMember(s, email)
-	if err != nil || !member.HasPassword(password) {
+	if err != nil {
 		return nil, respErr
 	}
+	if err := member.CheckLoginAllowed(); err != nil {
+		return nil, err
+	}
+	if !member.HasPassword(password) {
+		if err := member.RecordFailedLogin(s); err != nil {
+			return nil, err
+		}
+		return nil, respErr
+	}
+	// failed two factor codes count too, so only a passed challenge clears
+	// them for members with it enabled
+	if !member.TOTPEnabled {
+		if err := member.ResetFailedLogins(s); err != nil {
+			return nil, err
+		}
+	}
+	if err := member.upgradePasswordHash(s, password); err != nil {
+		return nil, err
+	}
 
 	return member, nil
 }
 
-func (m *Member) ResetPassword() error {
-	m.SetPassword(NewAutoPassword())
+// ResetPassword emails the member a single-use link to choose a new
+// password.  The current password keeps working until the link is used.
+func (m *Member) ResetPassword(s gorp.SqlExecutor) error {
+	reset := &PasswordReset{
+		MemberID: m.ID,
+	}
+	if err := s.Insert(reset); err != nil {
+		return err
+	}
+	return sendPasswordResetEmail(m, reset)
+}
 
-	// form invite email
-	body := fmt.Sprintf(passwordResetTemplate, m.Password)
-	recipient := fmt.Sprintf("%s <%s>", m.Name, m.Email)
-	message := mailgun.NewMessage(
-		"organizer@mobilemainst.com",
-		"Mobile Main Street Password Reset",
-		body, recipient)
-	return sendEmail(message)
+// RevokeCredentials logs m out everywhere and revokes its api keys, so a
+// deleted member can't keep using the api.
+func (m *Member) RevokeCredentials(s gorp.SqlExecutor) error {
+	if err := DeleteMemberTokens(s, m.ID); err != nil {
+		return err
+	}
+	return RevokeMemberAPIKeys(s, m.ID)
 }
 
 func (m *Member) Invite(email string) error {
@@ -149,9 +192,25 @@ func (m *Member) HasPassword(password string) bool {
 	return err == nil
 }
 
+// upgradePasswordHash re-hashes password, which must be the member's, if
+// the stored hash was made at a lower cost than the password policy sets.
+func (m *Member) upgradePasswordHash(s gorp.SqlExecutor, password string) error {
+	if !needsRehash(m.PasswordHash) {
+		return nil
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	m.PasswordHash = hash
+	format := "update " + TableNameMember + " set PasswordHash = ? where ID = ?"
+	_, err = s.Exec(format, m.PasswordHash, m.ID)
+	return err
+}
+
 func (m *Member) Validate() error {
 	if valid, errMap := val.Struct(m); !valid {
-		return ErrorFromMap(errMap)
+		return ErrorFromMap(m, errMap)
 	}
 	return nil
 }
@@ -162,12 +221,15 @@ func (m *Member) PreInsert(s gorp.SqlExecutor) error {
 	if m.Email == "" {
 		m.Email = fmt.Sprintf("%s@example.com", uniuri.NewLen(8))
 	}
-	if err := m.updateCategoires(s); err != nil {
-		return err
-	}
 	return m.Validate()
 }
 
+// PostInsert links the member's categories, which needs the id the insert
+// assigned.
+func (m *Member) PostInsert(s gorp.SqlExecutor) error {
+	return m.updateCategoires(s)
+}
+
 func (m *Member) PreUpdate(s gorp.SqlExecutor) error {
 	m.Updated = milli.Timestamp(time.Now())
 	if err := m.updateCategoires(s); err != nil {
@@ -177,10 +239,7 @@ func (m *Member) PreUpdate(s gorp.SqlExecutor) error {
 }
 
 func (m *Member) PostGet(s gorp.SqlExecutor) error {
-	m.Object = ObjectNameMember
-	m.Images = m.ImagesSlice()
-	m.Hashtags = m.HashtagsSlice()
-	m.Location = m.LocationCoords()
+	m.fillDerived()
 
 	catIds := []int64{}
 	catMems := []*CategoryMember{}
@@ -195,6 +254,14 @@ func (m *Member) PostGet(s gorp.SqlExecutor) error {
 	return nil
 }
 
+// fillDerived sets the fields computed from the stored ones.
+func (m *Member) fillDerived() {
+	m.Object = ObjectNameMember
+	m.Images = m.ImagesSlice()
+	m.Hashtags = m.HashtagsSlice()
+	m.Location = m.LocationCoords()
+}
+
 func (m *Member) updateCategoires(s gorp.SqlExecutor) error {
 	// delete existing categories
 	format := "delete from " + TableNameCategoryMember + " where memberid = ?"
@@ -226,6 +293,16 @@ func (m *Member) Delete() {
 	m.Deleted = true
 }
 
+func (m *Member) Restore() {
+	m.Deleted = false
+}
+
+// Owned interface
+
+func (m *Member) OwnerID() int64 {
+	return m.ID
+}
+
 // util
 
 func sendEmail(message *mailgun.Message) error {
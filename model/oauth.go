@@ -0,0 +1,150 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/garyburd/go-oauth/oauth"
+)
+
+// ExternalAccount is the account a provider vouches for at the end of an
+// OAuth exchange.
+type ExternalAccount struct {
+	Provider FeedType
+	ID       string
+	Handle   string
+}
+
+// oauthURL returns the provider endpoint configured under key, or d.  The
+// endpoints are configurable so a local fake can stand in for tests.
+func oauthURL(key, d string) string {
+	if u := os.Getenv(key); u != "" {
+		return u
+	}
+	return d
+}
+
+func twitterOAuthClient() *oauth.Client {
+	return &oauth.Client{
+		Credentials: oauth.Credentials{
+			Token:  os.Getenv("twitterApiKey"),
+			Secret: os.Getenv("twitterApiSecret"),
+		},
+		TemporaryCredentialRequestURI: oauthURL("twitterRequestTokenUrl", "https://api.twitter.com/oauth/request_token"),
+		ResourceOwnerAuthorizationURI: oauthURL("twitterAuthorizeUrl", "https://api.twitter.com/oauth/authenticate"),
+		TokenRequestURI:               oauthURL("twitterAccessTokenUrl", "https://api.twitter.com/oauth/access_token"),
+	}
+}
+
+// TwitterAuthorization starts an OAuth 1.0a exchange with Twitter.  It
+// returns the URL to send the member to and the temporary credentials needed
+// to finish the exchange.
+func TwitterAuthorization(callback string) (string, *oauth.Credentials, error) {
+	client := twitterOAuthClient()
+	temp, err := client.RequestTemporaryCredentials(http.DefaultClient, callback, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	return client.AuthorizationURL(temp, nil), temp, nil
+}
+
+// TwitterAccount finishes an OAuth 1.0a exchange with Twitter.
+func TwitterAccount(temp *oauth.Credentials, verifier string) (*ExternalAccount, error) {
+	_, values, err := twitterOAuthClient().RequestToken(http.DefaultClient, temp, verifier)
+	if err != nil {
+		return nil, err
+	}
+	account := &ExternalAccount{
+		Provider: FeedTypeTwitter,
+		ID:       values.Get("user_id"),
+		Handle:   values.Get("screen_name"),
+	}
+	if account.ID == "" {
+		return nil, errors.New("twitter did not return a user id")
+	}
+	return account, nil
+}
+
+// FacebookAuthorization returns the URL that starts an OAuth 2 exchange with
+// Facebook.
+func FacebookAuthorization(callback, state string) string {
+	v := url.Values{}
+	v.Set("client_id", os.Getenv("facebookApiID"))
+	v.Set("redirect_uri", callback)
+	v.Set("state", state)
+	return oauthURL("facebookDialogUrl", "https://www.facebook.com/dialog/oauth") + "?" + v.Encode()
+}
+
+// FacebookAccount finishes an OAuth 2 exchange with Facebook by trading code
+// for an access token and looking up who it belongs to.
+func FacebookAccount(callback, code string) (*ExternalAccount, error) {
+	v := url.Values{}
+	v.Set("client_id", os.Getenv("facebookApiID"))
+	v.Set("client_secret", os.Getenv("facebookAppSecret"))
+	v.Set("redirect_uri", callback)
+	v.Set("code", code)
+	tokenURL := oauthURL("facebookTokenUrl", "https://graph.facebook.com/oauth/access_token")
+	b, err := getBody(tokenURL + "?" + v.Encode())
+	if err != nil {
+		return nil, err
+	}
+
+	// facebook has answered with both json and form encoded tokens
+	accessToken := ""
+	tokenResp := struct {
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := json.Unmarshal(b, &tokenResp); err == nil {
+		accessToken = tokenResp.AccessToken
+	} else if values, err := url.ParseQuery(string(b)); err == nil {
+		accessToken = values.Get("access_token")
+	}
+	if accessToken == "" {
+		return nil, errors.New("facebook did not return an access token")
+	}
+
+	v = url.Values{}
+	v.Set("access_token", accessToken)
+	v.Set("fields", "id,name")
+	graphURL := oauthURL("facebookGraphUrl", "https://graph.facebook.com")
+	b, err = getBody(graphURL + "/me?" + v.Encode())
+	if err != nil {
+		return nil, err
+	}
+	me := struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	}{}
+	if err := json.Unmarshal(b, &me); err != nil {
+		return nil, err
+	}
+	if me.ID == "" {
+		return nil, errors.New("facebook did not return a user id")
+	}
+	return &ExternalAccount{
+		Provider: FeedTypeFacebook,
+		ID:       me.ID,
+		Handle:   me.ID,
+	}, nil
+}
+
+func getBody(u string) ([]byte, error) {
+	resp, err := http.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("oauth provider status %d, %s", resp.StatusCode, string(b))
+	}
+	return b, nil
+}
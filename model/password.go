@@ -1,33 +1,178 @@
 package model
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
 
 	"code.google.com/p/go.crypto/bcrypt"
+	"github.com/SyntropyDev/httperr"
 	"github.com/dchest/uniuri"
 )
 
+const (
+	passwordMinLengthEnv   = "passwordMinLength"
+	passwordMaxLengthEnv   = "passwordMaxLength"
+	passwordCharClassesEnv = "passwordCharClasses"
+	passwordWordlistEnv    = "passwordWordlist"
+	bcryptCostEnv          = "bcryptCost"
+)
+
+var (
+	wordlistMu sync.Mutex
+	wordlists  = map[string]map[string]bool{}
+)
+
 type Password struct {
 	text string
 	hash string
 }
 
+// PasswordPolicy is the set of rules new passwords must follow.
+type PasswordPolicy struct {
+	MinLength int
+	MaxLength int
+	// CharClasses is how many of lowercase, uppercase, digits and symbols
+	// a password must use.
+	CharClasses int
+	// Wordlist is a file of breached passwords, one per line, that can't
+	// be used.
+	Wordlist string
+	Cost     int
+}
+
+// CurrentPasswordPolicy returns the policy from config, defaulting to
+// passwords between 7 and 32 characters.
+func CurrentPasswordPolicy() *PasswordPolicy {
+	return &PasswordPolicy{
+		MinLength:   ConfigInt(passwordMinLengthEnv, 7),
+		MaxLength:   ConfigInt(passwordMaxLengthEnv, 32),
+		CharClasses: ConfigInt(passwordCharClassesEnv, 0),
+		Wordlist:    os.Getenv(passwordWordlistEnv),
+		Cost:        ConfigInt(bcryptCostEnv, bcrypt.DefaultCost),
+	}
+}
+
+// Check returns a 400 error describing the rule s breaks, if any.  Other
+// errors, like failing to read the wordlist, are internal.
+func (p *PasswordPolicy) Check(s string) error {
+	length := utf8.RuneCountInString(s)
+	if length < p.MinLength || length > p.MaxLength || charClasses(s) < p.CharClasses {
+		err := errors.New(p.Describe())
+		return httperr.New(http.StatusBadRequest, err.Error(), err)
+	}
+	breached, err := p.isBreached(s)
+	if err != nil {
+		return err
+	}
+	if breached {
+		err := errors.New("password is too common, please choose another")
+		return httperr.New(http.StatusBadRequest, err.Error(), err)
+	}
+	return nil
+}
+
+// LoadPasswordWordlist reads the configured wordlist, if there is one, so
+// a missing or empty file is found at startup rather than on signup.
+func LoadPasswordWordlist() error {
+	p := CurrentPasswordPolicy()
+	if p.Wordlist == "" {
+		return nil
+	}
+	words, err := p.words()
+	if err != nil {
+		return err
+	}
+	if len(words) == 0 {
+		return fmt.Errorf("%s, %s, is empty", passwordWordlistEnv, p.Wordlist)
+	}
+	return nil
+}
+
+// CheckBcryptCost returns an error if the configured bcrypt cost is out of
+// bcrypt's range, which would otherwise only show up when a password is
+// hashed.
+func CheckBcryptCost() error {
+	cost := CurrentPasswordPolicy().Cost
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		return fmt.Errorf("%s, %d, must be between %d and %d", bcryptCostEnv, cost, bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	return nil
+}
+
+// Describe returns the rules as a sentence for error messages.
+func (p *PasswordPolicy) Describe() string {
+	desc := fmt.Sprintf("password must be between %d and %d characters", p.MinLength, p.MaxLength)
+	if p.CharClasses > 0 {
+		desc += fmt.Sprintf(" and use at least %d of lowercase letters, uppercase letters, digits and symbols", p.CharClasses)
+	}
+	return desc
+}
+
+func (p *PasswordPolicy) isBreached(s string) (bool, error) {
+	if p.Wordlist == "" {
+		return false, nil
+	}
+	words, err := p.words()
+	if err != nil {
+		return false, err
+	}
+	return words[strings.ToLower(s)], nil
+}
+
+// words returns the lower case passwords in the wordlist, read once and
+// then cached.
+func (p *PasswordPolicy) words() (map[string]bool, error) {
+	wordlistMu.Lock()
+	defer wordlistMu.Unlock()
+	if words, ok := wordlists[p.Wordlist]; ok {
+		return words, nil
+	}
+
+	f, err := os.Open(p.Wordlist)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	words := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if word := strings.ToLower(strings.TrimSpace(scanner.Text())); word != "" {
+			words[word] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	wordlists[p.Wordlist] = words
+	return words, nil
+}
+
 func NewPassword(s string) (*Password, error) {
-	if !isValidPassword(s) {
-		err := fmt.Errorf("auth: invalid password - %v password must be between 7 and 32 characters", s)
+	if err := CurrentPasswordPolicy().Check(s); err != nil {
 		return nil, err
 	}
-	b, err := bcrypt.GenerateFromPassword([]byte(s), bcrypt.DefaultCost)
+	hash, err := hashPassword(s)
 	if err != nil {
 		return nil, err
 	}
-	return &Password{s, string(b)}, nil
+	return &Password{s, hash}, nil
 }
 
-func NewAutoPassword() *Password {
+func NewAutoPassword() (*Password, error) {
 	s := uniuri.NewLen(15)
-	b, _ := bcrypt.GenerateFromPassword([]byte(s), bcrypt.DefaultCost)
-	return &Password{s, string(b)}
+	hash, err := hashPassword(s)
+	if err != nil {
+		return nil, err
+	}
+	return &Password{s, hash}, nil
 }
 
 func (p *Password) Hash() string {
@@ -38,8 +183,35 @@ func (p *Password) String() string {
 	return p.text
 }
 
-func isValidPassword(p string) bool {
-	hasMin := len(p) >= 7
-	hasMax := len(p) <= 32
-	return hasMin && hasMax
+// hashPassword hashes s at the cost set by the password policy.
+func hashPassword(s string) (string, error) {
+	b, err := bcrypt.GenerateFromPassword([]byte(s), CurrentPasswordPolicy().Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// needsRehash returns true if hash was made at a lower cost than the
+// password policy now sets.
+func needsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err == nil && cost < CurrentPasswordPolicy().Cost
+}
+
+func charClasses(s string) int {
+	lower, upper, digit, symbol := 0, 0, 0, 0
+	for _, r := range s {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+	return lower + upper + digit + symbol
 }
@@ -0,0 +1,135 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/SyntropyDev/httperr"
+	"github.com/SyntropyDev/milli"
+	"github.com/SyntropyDev/sqlutil"
+	"github.com/SyntropyDev/val"
+	"github.com/coopernurse/gorp"
+	"github.com/dchest/uniuri"
+	"github.com/lann/squirrel"
+	"github.com/mailgun/mailgun-go"
+)
+
+const (
+	ModelNamePasswordReset = "PasswordReset"
+	TableNamePasswordReset = "password_resets"
+
+	passwordResetURLEnv = "passwordResetUrl"
+	passwordResetTTL    = time.Hour
+)
+
+// PasswordReset is a single-use link that lets a member choose a new
+// password.  Like tokens only a keyed hash of the value is stored.
+type PasswordReset struct {
+	ID        int64  `json:"id"`
+	Created   int64  `json:"created" val:"nonzero"`
+	Updated   int64  `json:"updated" val:"nonzero"`
+	Deleted   bool   `json:"deleted"`
+	ModelName string `db:"-" json:"modelName"`
+
+	MemberID   int64  `json:"memberId" val:"nonzero"`
+	Value      string `db:"-" json:"-"`
+	Hash       string `json:"-" val:"nonzero" audit:"secret"`
+	Expiration int64  `json:"expirationTimestamp" val:"nonzero"`
+	Used       bool   `json:"used"`
+}
+
+// ConfirmPasswordReset sets the password of the member the reset link value
+// was issued to, uses up the link and logs the member out everywhere.
+func ConfirmPasswordReset(s gorp.SqlExecutor, value, password string) (*Member, error) {
+	query := squirrel.Select("*").From(TableNamePasswordReset).
+		Where(squirrel.Eq{"Hash": hashToken(value), "Used": false})
+	resets := []*PasswordReset{}
+	sqlutil.Select(s, query, &resets)
+	if len(resets) == 0 || resets[0].IsExpired() {
+		err := errors.New("password reset link is invalid or expired")
+		return nil, httperr.New(http.StatusBadRequest, err.Error(), err)
+	}
+	reset := resets[0]
+
+	pword, err := NewPassword(password)
+	if err != nil {
+		return nil, err
+	}
+
+	member := &Member{}
+	if err := sqlutil.SelectOneRelation(s, TableNameMember, reset.MemberID, member); err != nil {
+		return nil, err
+	}
+	member.SetPassword(pword)
+	if _, err := s.Update(member); err != nil {
+		return nil, err
+	}
+
+	// every outstanding link for the member is spent once one is used
+	format := "update " + TableNamePasswordReset + " set Used = ? where MemberID = ?"
+	if _, err := s.Exec(format, true, member.ID); err != nil {
+		return nil, err
+	}
+	if err := DeleteMemberTokens(s, member.ID); err != nil {
+		return nil, err
+	}
+	return member, nil
+}
+
+// PurgeExpiredPasswordResets removes every reset link past its expiration.
+func PurgeExpiredPasswordResets(s gorp.SqlExecutor) error {
+	format := "delete from " + TableNamePasswordReset + " where Expiration < ?"
+	_, err := s.Exec(format, milli.Timestamp(time.Now()))
+	return err
+}
+
+// URL returns the link emailed to the member.  It is only available before
+// the reset is inserted.
+func (p *PasswordReset) URL() string {
+	return fmt.Sprintf("%s?token=%s", os.Getenv(passwordResetURLEnv), url.QueryEscape(p.Value))
+}
+
+func (p *PasswordReset) IsExpired() bool {
+	exp := milli.Time(p.Expiration)
+	return time.Now().After(exp)
+}
+
+func (p *PasswordReset) Validate() error {
+	if valid, errMap := val.Struct(p); !valid {
+		return ErrorFromMap(p, errMap)
+	}
+	return nil
+}
+
+func (p *PasswordReset) PreInsert(s gorp.SqlExecutor) error {
+	p.Created = milli.Timestamp(time.Now())
+	p.Updated = milli.Timestamp(time.Now())
+	p.Value = uniuri.NewLen(40)
+	p.Hash = hashToken(p.Value)
+	p.Expiration = milli.Timestamp(time.Now().Add(passwordResetTTL))
+	return p.Validate()
+}
+
+func (p *PasswordReset) PreUpdate(s gorp.SqlExecutor) error {
+	p.Updated = milli.Timestamp(time.Now())
+	return p.Validate()
+}
+
+func (p *PasswordReset) PostGet(s gorp.SqlExecutor) error {
+	p.ModelName = ModelNamePasswordReset
+	return nil
+}
+
+func sendPasswordResetEmail(m *Member, p *PasswordReset) error {
+	body := fmt.Sprintf(passwordResetTemplate, p.URL())
+	recipient := fmt.Sprintf("%s <%s>", m.Name, m.Email)
+	message := mailgun.NewMessage(
+		"organizer@mobilemainst.com",
+		"Mobile Main Street Password Reset",
+		body, recipient)
+	return sendEmail(message)
+}
@@ -0,0 +1,27 @@
+package model
+
+import (
+	"os"
+	"testing"
+)
+
+func TestPasswordLengthCountsCharacters(t *testing.T) {
+	p := &PasswordPolicy{MinLength: 7, MaxLength: 8}
+	// eight characters, but sixteen bytes
+	if err := p.Check("ééééééé1"); err != nil {
+		t.Errorf("an eight character password was refused: %v", err)
+	}
+	if err := p.Check("éééé"); err == nil {
+		t.Error("a four character password was accepted")
+	}
+}
+
+func TestCheckBcryptCost(t *testing.T) {
+	defer os.Setenv(bcryptCostEnv, "")
+	for cost, valid := range map[string]bool{"": true, "4": true, "3": false, "32": false} {
+		os.Setenv(bcryptCostEnv, cost)
+		if err := CheckBcryptCost(); (err == nil) != valid {
+			t.Errorf("cost %q gave %v", cost, err)
+		}
+	}
+}
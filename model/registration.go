@@ -0,0 +1,208 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/SyntropyDev/httperr"
+	"github.com/SyntropyDev/milli"
+	"github.com/SyntropyDev/sqlutil"
+	"github.com/SyntropyDev/val"
+	"github.com/coopernurse/gorp"
+	"github.com/lann/squirrel"
+	"github.com/mailgun/mailgun-go"
+)
+
+const (
+	ObjectNameRegistration = "Registration"
+	TableNameRegistration  = "registrations"
+
+	RegistrationStatusPending  = "pending"
+	RegistrationStatusApproved = "approved"
+	RegistrationStatusRejected = "rejected"
+
+	registrationWelcomeTemplate  = "Welcome to Mobile Main Street, %s!  You can now log in with %s."
+	registrationPendingTemplate  = "Thanks for your interest in Mobile Main Street, %s.  An organizer will review your request soon."
+	registrationApprovedTemplate = "Your request to join Mobile Main Street has been approved, %s!  You can now log in with %s."
+	registrationRejectedTemplate = "Sorry %s, your request to join Mobile Main Street was not approved."
+)
+
+// Registration is a request to join a community whose registration policy
+// is closed.  It waits for an organizer to approve or reject it.
+type Registration struct {
+	ID      int64  `json:"id" filter:"true"`
+	Created int64  `json:"created" val:"nonzero" filter:"true"`
+	Updated int64  `json:"updated" val:"nonzero" filter:"true"`
+	Deleted bool   `json:"deleted" filter:"true"`
+	Object  string `db:"-" json:"object"`
+
+	Name         string `json:"name" val:"nonzero" filter:"true"`
+	Email        string `json:"email" val:"nonzero" filter:"true"`
+	PasswordHash string `json:"-" val:"nonzero" audit:"secret"`
+	Status       string `json:"status" val:"in(pending,approved,rejected)" filter:"true"`
+	MemberID     int64  `json:"memberId" filter:"true"`
+}
+
+// Register adds a business member to the community when its registration
+// policy is open.  Otherwise it queues a pending registration for the
+// organizers.  Exactly one of the returned member and registration is non
+// nil.  Once s commits, the applicant should be emailed with the member's
+// Welcome or the registration's Notify.
+func Register(s gorp.SqlExecutor, c *Community, name, email string, p *Password) (*Member, *Registration, error) {
+	if _, err := FindMember(s, email); err == nil {
+		err := errors.New("email already registered")
+		return nil, nil, httperr.New(http.StatusBadRequest, err.Error(), err)
+	}
+
+	if c.RegistrationPolicy == RegistrationPolicyOpen {
+		member := &Member{
+			Email: email,
+			Name:  name,
+		}
+		member.SetPassword(p)
+		if err := s.Insert(member); err != nil {
+			return nil, nil, err
+		}
+		return member, nil, nil
+	}
+
+	query := squirrel.Select("*").From(TableNameRegistration).
+		Where(squirrel.Eq{"Email": email, "Status": RegistrationStatusPending})
+	pending := []*Registration{}
+	if err := sqlutil.Select(s, query, &pending); err != nil {
+		return nil, nil, err
+	}
+	if len(pending) > 0 {
+		err := errors.New("registration already pending")
+		return nil, nil, httperr.New(http.StatusBadRequest, err.Error(), err)
+	}
+
+	reg := &Registration{
+		Name:         name,
+		Email:        email,
+		PasswordHash: p.Hash(),
+		Status:       RegistrationStatusPending,
+	}
+	if err := s.Insert(reg); err != nil {
+		return nil, nil, err
+	}
+	return nil, reg, nil
+}
+
+// Approve creates the business member for a pending registration with the
+// password the applicant chose.  Once s commits, the applicant should be
+// emailed with Notify.
+func (reg *Registration) Approve(s gorp.SqlExecutor) (*Member, error) {
+	if err := reg.checkPending(); err != nil {
+		return nil, err
+	}
+	if _, err := FindMember(s, reg.Email); err == nil {
+		err := errors.New("email already registered")
+		return nil, httperr.New(http.StatusBadRequest, err.Error(), err)
+	}
+
+	member := &Member{
+		Email:        reg.Email,
+		Name:         reg.Name,
+		PasswordHash: reg.PasswordHash,
+	}
+	if err := s.Insert(member); err != nil {
+		return nil, err
+	}
+
+	reg.Status = RegistrationStatusApproved
+	reg.MemberID = member.ID
+	if _, err := s.Update(reg); err != nil {
+		return nil, err
+	}
+	return member, nil
+}
+
+// Reject closes a pending registration.  Once s commits, the applicant
+// should be emailed with Notify.
+func (reg *Registration) Reject(s gorp.SqlExecutor) error {
+	if err := reg.checkPending(); err != nil {
+		return err
+	}
+	reg.Status = RegistrationStatusRejected
+	_, err := s.Update(reg)
+	return err
+}
+
+// Notify emails the applicant about the status of reg.  It isn't part of
+// Register, Approve or Reject so that no mail goes out for a change that's
+// rolled back.
+func (reg *Registration) Notify() error {
+	var body string
+	switch reg.Status {
+	case RegistrationStatusApproved:
+		body = fmt.Sprintf(registrationApprovedTemplate, reg.Name, reg.Email)
+	case RegistrationStatusRejected:
+		body = fmt.Sprintf(registrationRejectedTemplate, reg.Name)
+	default:
+		body = fmt.Sprintf(registrationPendingTemplate, reg.Name)
+	}
+	return sendRegistrationEmail(reg.Name, reg.Email, body)
+}
+
+// Welcome emails a member who joined through open registration.
+func (m *Member) Welcome() error {
+	body := fmt.Sprintf(registrationWelcomeTemplate, m.Name, m.Email)
+	return sendRegistrationEmail(m.Name, m.Email, body)
+}
+
+func (reg *Registration) checkPending() error {
+	if reg.Status != RegistrationStatusPending {
+		err := fmt.Errorf("registration already %s", reg.Status)
+		return httperr.New(http.StatusBadRequest, err.Error(), err)
+	}
+	return nil
+}
+
+func (reg *Registration) Validate() error {
+	if valid, errMap := val.Struct(reg); !valid {
+		return ErrorFromMap(reg, errMap)
+	}
+	return nil
+}
+
+func (reg *Registration) PreInsert(s gorp.SqlExecutor) error {
+	reg.Created = milli.Timestamp(time.Now())
+	reg.Updated = milli.Timestamp(time.Now())
+	return reg.Validate()
+}
+
+func (reg *Registration) PreUpdate(s gorp.SqlExecutor) error {
+	reg.Updated = milli.Timestamp(time.Now())
+	return reg.Validate()
+}
+
+func (reg *Registration) PostGet(s gorp.SqlExecutor) error {
+	reg.Object = ObjectNameRegistration
+	return nil
+}
+
+// CrudResource interface
+
+func (reg *Registration) TableName() string {
+	return TableNameRegistration
+}
+
+func (reg *Registration) TableId() int64 {
+	return reg.ID
+}
+
+func (reg *Registration) Delete() {
+	reg.Deleted = true
+}
+
+func sendRegistrationEmail(name, email, body string) error {
+	recipient := fmt.Sprintf("%s <%s>", name, email)
+	message := mailgun.NewMessage(
+		"organizer@mobilemainst.com",
+		"Mobile Main Street Registration",
+		body, recipient)
+	return sendEmail(message)
+}
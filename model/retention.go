@@ -0,0 +1,74 @@
+package model
+
+import (
+	"time"
+
+	"github.com/SyntropyDev/milli"
+	"github.com/coopernurse/gorp"
+)
+
+const (
+	// deletedRetentionEnv names the config value holding how many days soft
+	// deleted rows are kept before they're purged.  Zero, the default, keeps
+	// them forever.
+	deletedRetentionEnv     = "deletedRetentionDays"
+	defaultDeletedRetention = 0
+)
+
+// PurgeDeleted hard deletes stories, feeds, categories and members that
+// have been soft deleted for longer than the retention period, along with
+// the rows that depend on them.  Deleting a row sets its Updated stamp, so
+// that is taken as the time it was deleted.  The statements run in one
+// transaction, begun here unless s is one already, so a failure leaves
+// nothing half purged.
+func PurgeDeleted(s gorp.SqlExecutor) error {
+	days := ConfigInt(deletedRetentionEnv, defaultDeletedRetention)
+	if days <= 0 {
+		return nil
+	}
+	cutoff := milli.Timestamp(time.Now().Add(-time.Duration(days) * 24 * time.Hour))
+
+	purged := func(table string) string {
+		return "select ID from " + table + " where Deleted = 1 and Updated < ?"
+	}
+
+	// children before parents to satisfy the foreign keys
+	stmts := []string{
+		"delete from " + TableNameStory + " where Deleted = 1 and Updated < ?",
+		"delete from " + TableNameStory + " where FeedID in (" + purged(TableNameFeed) + ")",
+		"delete from " + TableNameStory + " where MemberID in (" + purged(TableNameMember) + ")",
+		"delete from " + TableNameFeed + " where MemberID in (" + purged(TableNameMember) + ")",
+		"delete from " + TableNameFeed + " where Deleted = 1 and Updated < ?",
+		"delete from " + TableNameCategoryMember + " where CategoryID in (" + purged(TableNameCategory) + ")",
+		"delete from " + TableNameCategory + " where Deleted = 1 and Updated < ?",
+		"delete from " + TableNameCategoryMember + " where MemberID in (" + purged(TableNameMember) + ")",
+		"delete from " + TableNameToken + " where MemberID in (" + purged(TableNameMember) + ")",
+		"delete from " + TableNamePasswordReset + " where MemberID in (" + purged(TableNameMember) + ")",
+		"delete from " + TableNameIdentity + " where MemberID in (" + purged(TableNameMember) + ")",
+		"delete from " + TableNameAPIKey + " where MemberID in (" + purged(TableNameMember) + ")",
+		"delete from " + TableNameMember + " where Deleted = 1 and Updated < ?",
+	}
+
+	dbmap, ok := s.(*gorp.DbMap)
+	if !ok {
+		return execAll(s, stmts, cutoff)
+	}
+	trans, err := dbmap.Begin()
+	if err != nil {
+		return err
+	}
+	if err := execAll(trans, stmts, cutoff); err != nil {
+		trans.Rollback()
+		return err
+	}
+	return trans.Commit()
+}
+
+func execAll(s gorp.SqlExecutor, stmts []string, args ...interface{}) error {
+	for _, stmt := range stmts {
+		if _, err := s.Exec(stmt, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
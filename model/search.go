@@ -0,0 +1,341 @@
+package model
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/SyntropyDev/sqlutil"
+	"github.com/coopernurse/gorp"
+	"github.com/lann/squirrel"
+)
+
+const (
+	// searchCandidates limits how many index matches are loaded before
+	// filtering and ranking.
+	searchCandidates = 1000
+)
+
+// SearchQuery is a full text search over stories and members.  CategoryID
+// and FeedType narrow both to members in the category or with a feed of the
+// type, From and To narrow stories by their millisecond timestamp.  Zero
+// values don't filter.
+type SearchQuery struct {
+	Text       string
+	CategoryID int64
+	FeedType   string
+	From       int64
+	To         int64
+	Limit      uint64
+}
+
+// SearchResults holds the matches for a search, best first.
+type SearchResults struct {
+	Stories []*Story  `json:"stories"`
+	Members []*Member `json:"members"`
+}
+
+// Searcher ranks the stories and members matching a search.
+type Searcher interface {
+	Search(s gorp.SqlExecutor, q *SearchQuery) (*SearchResults, error)
+}
+
+// filtered returns true if q narrows the results by more than their text.
+func (q *SearchQuery) filtered() bool {
+	return q.CategoryID != 0 || q.FeedType != "" || q.From != 0 || q.To != 0
+}
+
+// storyQuery selects columns of the stories matching q's filters.  Like
+// top stories, those of deleted members and feeds are left out.
+func (q *SearchQuery) storyQuery(columns string) squirrel.SelectBuilder {
+	query := squirrel.Select(columns).From(TableNameStory).
+		Where("Deleted = ?", false).
+		Where("MemberID in (select ID from "+TableNameMember+" where Deleted = ?)", false).
+		Where("FeedID in (select ID from "+TableNameFeed+" where Deleted = ?)", false)
+	if q.CategoryID != 0 {
+		query = query.Where("MemberID in (select MemberID from "+TableNameCategoryMember+" where CategoryID = ?)", q.CategoryID)
+	}
+	if q.FeedType != "" {
+		query = query.Where("FeedType = ?", q.FeedType)
+	}
+	if q.From != 0 {
+		query = query.Where("Timestamp >= ?", q.From)
+	}
+	if q.To != 0 {
+		query = query.Where("Timestamp <= ?", q.To)
+	}
+	return query
+}
+
+// memberQuery selects columns of the members matching q's filters.
+func (q *SearchQuery) memberQuery(columns string) squirrel.SelectBuilder {
+	query := squirrel.Select(columns).From(TableNameMember).
+		Where("Deleted = ?", false)
+	if q.CategoryID != 0 {
+		query = query.Where("ID in (select MemberID from "+TableNameCategoryMember+" where CategoryID = ?)", q.CategoryID)
+	}
+	if q.FeedType != "" {
+		query = query.Where("ID in (select MemberID from "+TableNameFeed+" where Type = ? and Deleted = 0)", q.FeedType)
+	}
+	return query
+}
+
+// MySQLSearcher searches with the FULLTEXT indexes on stories.Body and
+// members.Name and Description.
+type MySQLSearcher struct{}
+
+func (MySQLSearcher) Search(s gorp.SqlExecutor, q *SearchQuery) (*SearchResults, error) {
+	results := &SearchResults{Stories: []*Story{}}
+
+	// squirrel's order by takes no arguments, so the ordering by
+	// relevance, and the limit after it, are added as a suffix
+	storyQuery := q.storyQuery("*").
+		Where("MATCH(Body) AGAINST (?)", q.Text).
+		Suffix(relevanceSuffix("MATCH(Body) AGAINST (?)", q.Limit), q.Text)
+	if err := sqlutil.Select(s, storyQuery, &results.Stories); err != nil {
+		return nil, err
+	}
+
+	memberQuery := q.memberQuery("*").
+		Where("MATCH(Name, Description) AGAINST (?)", q.Text).
+		Suffix(relevanceSuffix("MATCH(Name, Description) AGAINST (?)", q.Limit), q.Text)
+	members, err := selectMembers(s, memberQuery)
+	if err != nil {
+		return nil, err
+	}
+	results.Members = members
+	return results, nil
+}
+
+// relevanceSuffix orders by the relevance match computes, best first, and
+// limits the rows.
+func relevanceSuffix(match string, limit uint64) string {
+	return fmt.Sprintf("ORDER BY %s DESC LIMIT %d", match, limit)
+}
+
+// MemoryIndex is an in process inverted index for tests and small
+// deployments without FULLTEXT support.  Rebuild must be called to load it
+// and again to pick up changes.
+type MemoryIndex struct {
+	mu      sync.RWMutex
+	stories *invertedIndex
+	members *invertedIndex
+}
+
+func NewMemoryIndex() *MemoryIndex {
+	return &MemoryIndex{
+		stories: newInvertedIndex(),
+		members: newInvertedIndex(),
+	}
+}
+
+// Rebuild indexes every member that isn't deleted, and every story that
+// isn't deleted and whose member and feed aren't either.
+func (idx *MemoryIndex) Rebuild(s gorp.SqlExecutor) error {
+	type storyText struct {
+		ID   int64
+		Body string
+	}
+	type memberText struct {
+		ID          int64
+		Name        string
+		Description string
+	}
+
+	stories := []*storyText{}
+	query := "select ID, Body from " + TableNameStory + " where Deleted = 0" +
+		" and MemberID in (select ID from " + TableNameMember + " where Deleted = 0)" +
+		" and FeedID in (select ID from " + TableNameFeed + " where Deleted = 0)"
+	if _, err := s.Select(&stories, query); err != nil {
+		return err
+	}
+	members := []*memberText{}
+	query = "select ID, Name, Description from " + TableNameMember + " where Deleted = 0"
+	if _, err := s.Select(&members, query); err != nil {
+		return err
+	}
+
+	storyIndex, memberIndex := newInvertedIndex(), newInvertedIndex()
+	for _, story := range stories {
+		storyIndex.add(story.ID, story.Body)
+	}
+	for _, m := range members {
+		memberIndex.add(m.ID, m.Name+" "+m.Description)
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.stories, idx.members = storyIndex, memberIndex
+	return nil
+}
+
+func (idx *MemoryIndex) Search(s gorp.SqlExecutor, q *SearchQuery) (*SearchResults, error) {
+	idx.mu.RLock()
+	storyScores := idx.stories.search(q.Text)
+	memberScores := idx.members.search(q.Text)
+	idx.mu.RUnlock()
+
+	results := &SearchResults{Stories: []*Story{}, Members: []*Member{}}
+
+	// narrow the matches before taking the best candidates, or the
+	// candidates may hold none that pass the filters
+	if q.filtered() {
+		var err error
+		if storyScores, err = keepIDs(s, storyScores, q.storyQuery("ID")); err != nil {
+			return nil, err
+		}
+		if memberScores, err = keepIDs(s, memberScores, q.memberQuery("ID")); err != nil {
+			return nil, err
+		}
+	}
+
+	if ids := topIDs(storyScores, searchCandidates); len(ids) > 0 {
+		query := q.storyQuery("*").Where(squirrel.Eq{"ID": ids})
+		if err := sqlutil.Select(s, query, &results.Stories); err != nil {
+			return nil, err
+		}
+		sort.Sort(byScore{
+			len:   len(results.Stories),
+			id:    func(i int) int64 { return results.Stories[i].ID },
+			swap:  func(i, j int) { results.Stories[i], results.Stories[j] = results.Stories[j], results.Stories[i] },
+			score: storyScores,
+		})
+		if uint64(len(results.Stories)) > q.Limit {
+			results.Stories = results.Stories[:q.Limit]
+		}
+	}
+
+	if ids := topIDs(memberScores, searchCandidates); len(ids) > 0 {
+		members, err := selectMembers(s, q.memberQuery("*").Where(squirrel.Eq{"ID": ids}))
+		if err != nil {
+			return nil, err
+		}
+		sort.Sort(byScore{
+			len:   len(members),
+			id:    func(i int) int64 { return members[i].ID },
+			swap:  func(i, j int) { members[i], members[j] = members[j], members[i] },
+			score: memberScores,
+		})
+		if uint64(len(members)) > q.Limit {
+			members = members[:q.Limit]
+		}
+		results.Members = members
+	}
+	return results, nil
+}
+
+// keepIDs returns the scores of the ids query selects.
+func keepIDs(s gorp.SqlExecutor, scores map[int64]float64, query squirrel.SelectBuilder) (map[int64]float64, error) {
+	if len(scores) == 0 {
+		return scores, nil
+	}
+	ids := []int64{}
+	if err := sqlutil.Select(s, query, &ids); err != nil {
+		return nil, err
+	}
+	kept := map[int64]float64{}
+	for _, id := range ids {
+		if score, ok := scores[id]; ok {
+			kept[id] = score
+		}
+	}
+	return kept, nil
+}
+
+// invertedIndex maps each term to the documents containing it and how
+// often.
+type invertedIndex struct {
+	postings map[string]map[int64]int
+	lengths  map[int64]int
+}
+
+func newInvertedIndex() *invertedIndex {
+	return &invertedIndex{
+		postings: map[string]map[int64]int{},
+		lengths:  map[int64]int{},
+	}
+}
+
+func (idx *invertedIndex) add(id int64, text string) {
+	terms := searchTerms(text)
+	idx.lengths[id] = len(terms)
+	for _, term := range terms {
+		docs, ok := idx.postings[term]
+		if !ok {
+			docs = map[int64]int{}
+			idx.postings[term] = docs
+		}
+		docs[id]++
+	}
+}
+
+// search scores the documents containing any term in text by tf-idf.
+func (idx *invertedIndex) search(text string) map[int64]float64 {
+	scores := map[int64]float64{}
+	n := float64(len(idx.lengths))
+	for _, term := range searchTerms(text) {
+		docs := idx.postings[term]
+		if len(docs) == 0 {
+			continue
+		}
+		idf := math.Log(1 + n/float64(len(docs)))
+		for id, freq := range docs {
+			scores[id] += float64(freq) / float64(idx.lengths[id]) * idf
+		}
+	}
+	return scores
+}
+
+// searchTerms splits text into lower case words, dropping single
+// characters.
+func searchTerms(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	terms := []string{}
+	for _, w := range words {
+		if len([]rune(w)) > 1 {
+			terms = append(terms, w)
+		}
+	}
+	return terms
+}
+
+// topIDs returns up to n ids with the highest scores.
+func topIDs(scores map[int64]float64, n int) []int64 {
+	ids := make([]int64, 0, len(scores))
+	for id := range scores {
+		ids = append(ids, id)
+	}
+	sort.Sort(byScore{
+		len:   len(ids),
+		id:    func(i int) int64 { return ids[i] },
+		swap:  func(i, j int) { ids[i], ids[j] = ids[j], ids[i] },
+		score: scores,
+	})
+	if len(ids) > n {
+		ids = ids[:n]
+	}
+	return ids
+}
+
+// byScore sorts a list of rows by descending score, then by id.
+type byScore struct {
+	len   int
+	id    func(i int) int64
+	swap  func(i, j int)
+	score map[int64]float64
+}
+
+func (b byScore) Len() int      { return b.len }
+func (b byScore) Swap(i, j int) { b.swap(i, j) }
+func (b byScore) Less(i, j int) bool {
+	si, sj := b.score[b.id(i)], b.score[b.id(j)]
+	if si != sj {
+		return si > sj
+	}
+	return b.id(i) < b.id(j)
+}
@@ -0,0 +1,216 @@
+package model
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/coopernurse/gorp"
+)
+
+// searchDriver is a database/sql driver that records each query and
+// answers it with answer.
+type searchDriver struct {
+	queries []string
+	answer  func(query string, args []driver.Value) ([]string, [][]driver.Value)
+}
+
+func (d *searchDriver) Open(name string) (driver.Conn, error) {
+	return &searchConn{d}, nil
+}
+
+type searchConn struct {
+	d *searchDriver
+}
+
+func (c *searchConn) Prepare(query string) (driver.Stmt, error) {
+	c.d.queries = append(c.d.queries, query)
+	return &searchStmt{c.d, query}, nil
+}
+
+func (c *searchConn) Close() error {
+	return nil
+}
+
+func (c *searchConn) Begin() (driver.Tx, error) {
+	return nil, driver.ErrSkip
+}
+
+type searchStmt struct {
+	d     *searchDriver
+	query string
+}
+
+func (s *searchStmt) Close() error {
+	return nil
+}
+
+func (s *searchStmt) NumInput() int {
+	return -1
+}
+
+func (s *searchStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, driver.ErrSkip
+}
+
+func (s *searchStmt) Query(args []driver.Value) (driver.Rows, error) {
+	columns, rows := s.d.answer(s.query, args)
+	return &searchRows{columns: columns, rows: rows}, nil
+}
+
+type searchRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *searchRows) Columns() []string {
+	return r.columns
+}
+
+func (r *searchRows) Close() error {
+	return nil
+}
+
+func (r *searchRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+var searchDB = &searchDriver{}
+
+func init() {
+	sql.Register("searchtest", searchDB)
+}
+
+// searchStories are the stories the fake database holds, by ID.
+var searchStories = map[int64]string{
+	1: "coffee coffee and a shop",
+	2: "fresh coffee beans",
+	3: "tea house",
+}
+
+// answerSearch answers the queries MemoryIndex makes from searchStories.
+// Filtered id queries only match the stories in keep.
+func answerSearch(keep ...int64) func(string, []driver.Value) ([]string, [][]driver.Value) {
+	return func(query string, args []driver.Value) ([]string, [][]driver.Value) {
+		rows := [][]driver.Value{}
+		switch {
+		case strings.HasPrefix(query, "select ID, Body from "+TableNameStory):
+			for id, body := range searchStories {
+				rows = append(rows, []driver.Value{id, []byte(body)})
+			}
+			return []string{"ID", "Body"}, rows
+		case strings.HasPrefix(query, "SELECT ID FROM "+TableNameStory):
+			for _, id := range keep {
+				rows = append(rows, []driver.Value{id})
+			}
+			return []string{"ID"}, rows
+		case strings.HasPrefix(query, "SELECT * FROM "+TableNameStory):
+			for _, arg := range args {
+				if id, ok := arg.(int64); ok {
+					if body, ok := searchStories[id]; ok {
+						rows = append(rows, []driver.Value{id, []byte(body)})
+					}
+				}
+			}
+			return []string{"ID", "Body"}, rows
+		}
+		return []string{"ID"}, rows
+	}
+}
+
+func newSearchDbMap(t *testing.T) *gorp.DbMap {
+	db, err := sql.Open("searchtest", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &gorp.DbMap{Db: db, Dialect: gorp.MySQLDialect{Engine: "InnoDB", Encoding: "UTF8"}}
+}
+
+func storyIDs(stories []*Story) []int64 {
+	ids := []int64{}
+	for _, story := range stories {
+		ids = append(ids, story.ID)
+	}
+	return ids
+}
+
+func TestMemoryIndexRanksStories(t *testing.T) {
+	dbmap := newSearchDbMap(t)
+	searchDB.answer = answerSearch()
+	idx := NewMemoryIndex()
+	if err := idx.Rebuild(dbmap); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := idx.Search(dbmap, &SearchQuery{Text: "Coffee", Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// story 1 says coffee more often for its length than story 2, and
+	// story 3 doesn't say it at all
+	if ids := storyIDs(results.Stories); len(ids) != 2 || ids[0] != 1 || ids[1] != 2 {
+		t.Errorf("coffee found stories %v, want [1 2]", ids)
+	}
+
+	results, err = idx.Search(dbmap, &SearchQuery{Text: "coffee", Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := storyIDs(results.Stories); len(ids) != 1 || ids[0] != 1 {
+		t.Errorf("coffee limited to 1 found stories %v, want [1]", ids)
+	}
+}
+
+func TestMemoryIndexFiltersStories(t *testing.T) {
+	dbmap := newSearchDbMap(t)
+	searchDB.answer = answerSearch(2)
+	idx := NewMemoryIndex()
+	if err := idx.Rebuild(dbmap); err != nil {
+		t.Fatal(err)
+	}
+
+	searchDB.queries = nil
+	results, err := idx.Search(dbmap, &SearchQuery{Text: "coffee", FeedType: "twitter", Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the better match is filtered out before the candidates are taken,
+	// so the limit still leaves the story that passes
+	if ids := storyIDs(results.Stories); len(ids) != 1 || ids[0] != 2 {
+		t.Errorf("filtered search found stories %v, want [2]", ids)
+	}
+
+	for _, query := range searchDB.queries {
+		if !strings.Contains(query, " "+TableNameStory+" ") {
+			continue
+		}
+		for _, table := range []string{TableNameMember, TableNameFeed} {
+			if !strings.Contains(query, "in (select ID from "+table+" where Deleted = ?)") {
+				t.Errorf("%q doesn't leave out stories of deleted %s", query, table)
+			}
+		}
+	}
+}
+
+func TestMemoryIndexRebuildSkipsDeleted(t *testing.T) {
+	dbmap := newSearchDbMap(t)
+	searchDB.answer = answerSearch()
+	searchDB.queries = nil
+	if err := NewMemoryIndex().Rebuild(dbmap); err != nil {
+		t.Fatal(err)
+	}
+
+	query := searchDB.queries[0]
+	for _, table := range []string{TableNameMember, TableNameFeed} {
+		if !strings.Contains(query, "in (select ID from "+table+" where Deleted = 0)") {
+			t.Errorf("%q indexes stories of deleted %s", query, table)
+		}
+	}
+}
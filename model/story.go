@@ -23,22 +23,22 @@ const (
 )
 
 type Story struct {
-	ID      int64  `json:"id"`
-	Created int64  `json:"created" val:"nonzero"`
-	Updated int64  `json:"updated" val:"nonzero"`
-	Deleted bool   `json:"deleted" merge:"true"`
+	ID      int64  `json:"id" filter:"true"`
+	Created int64  `json:"created" val:"nonzero" filter:"true"`
+	Updated int64  `json:"updated" val:"nonzero" filter:"true"`
+	Deleted bool   `json:"deleted" filter:"true"`
 	Object  string `db:"-" json:"object"`
 
-	MemberID           int64     `json:"memberId" val:"nonzero"`
-	MemberName         string    `json:"memberName"`
-	FeedID             int64     `json:"feedId" val:"nonzero"`
-	FeedIdentifier     string    `json:"feedIdentifier"`
-	FeedType           string    `json:"feedType"`
-	Timestamp          int64     `json:"timestamp"`
-	Body               string    `json:"body"`
-	SourceURL          string    `json:"sourceUrl"`
-	SourceID           string    `json:"sourceId"`
-	Score              float64   `json:"score"`
+	MemberID           int64     `json:"memberId" val:"nonzero" filter:"true"`
+	MemberName         string    `json:"memberName" filter:"true"`
+	FeedID             int64     `json:"feedId" val:"nonzero" filter:"true"`
+	FeedIdentifier     string    `json:"feedIdentifier" filter:"true"`
+	FeedType           string    `json:"feedType" filter:"true"`
+	Timestamp          int64     `json:"timestamp" filter:"true"`
+	Body               string    `json:"body" filter:"true"`
+	SourceURL          string    `json:"sourceUrl" filter:"true"`
+	SourceID           string    `json:"sourceId" filter:"true"`
+	Score              float64   `json:"score" filter:"true"`
 	Latitude           float64   `json:"-"`
 	Longitude          float64   `json:"-"`
 	LinksRaw           string    `json:"-"`
@@ -51,6 +51,10 @@ type Story struct {
 	Hashtags           []string  `db:"-" json:"hashTags"`
 	Location           []float64 `db:"-" json:"location"`
 	MemberIcon         string    `db:"-" json:"memberIcon"`
+
+	// embedded with q-expand
+	Member *Member `db:"-" json:"member,omitempty"`
+	Feed   *Feed   `db:"-" json:"feed,omitempty"`
 }
 
 func NewFacebookStory(member *Member, feed *Feed, post *FacebookPost) *Story {
@@ -282,7 +286,7 @@ func (story *Story) CalculateScore(s gorp.SqlExecutor) error {
 
 func (story *Story) Validate() error {
 	if valid, errMap := val.Struct(story); !valid {
-		return ErrorFromMap(errMap)
+		return ErrorFromMap(story, errMap)
 	}
 	return nil
 }
@@ -332,13 +336,8 @@ func (story *Story) PostGet(s gorp.SqlExecutor) error {
 	story.Hashtags = story.HashtagsSlice()
 	story.Location = story.LocationCoords()
 
-	m := &Member{}
-	if err := sqlutil.SelectOneRelation(s, TableNameMember, story.MemberID, m); err != nil {
-		return err
-	}
-
-	story.MemberIcon = m.Icon
-	story.CategoryIds = m.CategoryIds
+	// MemberIcon and CategoryIds are copied from the member by Expand,
+	// which loads them for a whole page at once
 	return nil
 }
 
@@ -356,6 +355,10 @@ func (story *Story) Delete() {
 	story.Deleted = true
 }
 
+func (story *Story) Restore() {
+	story.Deleted = false
+}
+
 func sliceFromString(s string) []string {
 	if s == "" {
 		return []string{}
@@ -1,7 +1,12 @@
 package model
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/SyntropyDev/milli"
@@ -15,6 +20,8 @@ import (
 const (
 	ModelNameToken = "Token"
 	TableNameToken = "tokens"
+
+	tokenSecretEnv = "tokenSecret"
 )
 
 type Token struct {
@@ -25,21 +32,141 @@ type Token struct {
 	ModelName string `db:"-" json:"modelName"`
 
 	MemberID   int64  `json:"memberId" val:"nonzero"`
-	Value      string `json:"value" val:"nonzero"`
+	Value      string `db:"-" json:"value,omitempty"`
+	Hash       string `json:"-" val:"nonzero" audit:"secret"`
 	Expiration int64  `json:"expirationTimestamp" val:"nonzero"`
+
+	// session
+	UserAgent string `json:"userAgent"`
+	IP        string `json:"ip"`
+	LastUsed  int64  `json:"lastUsed"`
+	Current   bool   `db:"-" json:"current"`
 }
 
-func ValidateToken(s gorp.SqlExecutor, memberID int64, token string) error {
+var (
+	tokenUsageMu sync.Mutex
+	tokenUsage   = map[int64]int64{}
+)
+
+func ValidateToken(s gorp.SqlExecutor, memberID int64, token string) (*Token, error) {
 	query := squirrel.Select("*").From(TableNameToken).
-		Where(squirrel.Eq{"MemberID": memberID, "Value": token})
+		Where(squirrel.Eq{"MemberID": memberID, "Hash": hashToken(token)})
 	tokens := []*Token{}
 	sqlutil.Select(s, query, &tokens)
 	if len(tokens) == 0 {
-		return fmt.Errorf("token not found")
+		return nil, fmt.Errorf("token not found")
+	}
+	if tokens[0].IsExpired() {
+		return nil, fmt.Errorf("token expired")
+	}
+	return tokens[0], nil
+}
+
+// FindToken returns the unexpired token with the given value.
+func FindToken(s gorp.SqlExecutor, token string) (*Token, error) {
+	query := squirrel.Select("*").From(TableNameToken).
+		Where(squirrel.Eq{"Hash": hashToken(token)})
+	tokens := []*Token{}
+	sqlutil.Select(s, query, &tokens)
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("token not found")
+	}
+	if tokens[0].IsExpired() {
+		return nil, fmt.Errorf("token expired")
+	}
+	return tokens[0], nil
+}
+
+// MemberTokens returns the unexpired tokens belonging to memberID, the
+// member's sessions, with recent use that hasn't been flushed yet.
+func MemberTokens(s gorp.SqlExecutor, memberID int64) ([]*Token, error) {
+	query := squirrel.Select("*").From(TableNameToken).
+		Where(squirrel.Eq{"MemberID": memberID}).
+		Where("Expiration >= ?", milli.Timestamp(time.Now())).
+		OrderBy("Created desc")
+	tokens := []*Token{}
+	if err := sqlutil.Select(s, query, &tokens); err != nil {
+		return nil, err
+	}
+
+	tokenUsageMu.Lock()
+	defer tokenUsageMu.Unlock()
+	for _, t := range tokens {
+		if used, ok := tokenUsage[t.ID]; ok && used > t.LastUsed {
+			t.LastUsed = used
+		}
+	}
+	return tokens, nil
+}
+
+// TouchToken records that t was just used.  Use is kept in memory and
+// written by FlushTokenUsage so requests don't each cost a write.
+func TouchToken(t *Token) {
+	tokenUsageMu.Lock()
+	defer tokenUsageMu.Unlock()
+	tokenUsage[t.ID] = milli.Timestamp(time.Now())
+}
+
+// FlushTokenUsage writes the use recorded by TouchToken.
+func FlushTokenUsage(s gorp.SqlExecutor) error {
+	tokenUsageMu.Lock()
+	usage := tokenUsage
+	tokenUsage = map[int64]int64{}
+	tokenUsageMu.Unlock()
+
+	format := "update " + TableNameToken + " set LastUsed = ? where ID = ? and LastUsed < ?"
+	for id, used := range usage {
+		if _, err := s.Exec(format, used, id, used); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+// DeleteMemberTokens removes every token belonging to memberID, logging the
+// member out everywhere.
+func DeleteMemberTokens(s gorp.SqlExecutor, memberID int64) error {
+	format := "delete from " + TableNameToken + " where MemberID = ?"
+	_, err := s.Exec(format, memberID)
+	return err
+}
+
+// PurgeExpiredTokens removes every token past its expiration.
+func PurgeExpiredTokens(s gorp.SqlExecutor) error {
+	format := "delete from " + TableNameToken + " where Expiration < ?"
+	_, err := s.Exec(format, milli.Timestamp(time.Now()))
+	return err
+}
+
+// MigrateTokenHashes hashes the plaintext values older versions stored in
+// the tokens table and drops the column, so existing sessions keep working
+// until they expire.
+func MigrateTokenHashes(s gorp.SqlExecutor) error {
+	query := "select count(*) from information_schema.columns " +
+		"where table_schema = database() and table_name = ? and column_name = 'Value'"
+	n, err := s.SelectInt(query, TableNameToken)
+	if err != nil || n == 0 {
+		return err
+	}
+
+	type legacyToken struct {
+		ID    int64
+		Value string
+	}
+	legacy := []*legacyToken{}
+	if _, err := s.Select(&legacy, "select ID, Value from "+TableNameToken); err != nil {
+		return err
+	}
+	for _, t := range legacy {
+		format := "update " + TableNameToken + " set Hash = ? where ID = ?"
+		if _, err := s.Exec(format, hashToken(t.Value), t.ID); err != nil {
+			return err
+		}
+	}
+	_, err = s.Exec("alter table " + TableNameToken + " drop column Value")
+	return err
+}
+
 func (t *Token) IsExpired() bool {
 	exp := milli.Time(t.Expiration)
 	return time.Now().After(exp)
@@ -47,7 +174,7 @@ func (t *Token) IsExpired() bool {
 
 func (t *Token) Validate() error {
 	if valid, errMap := val.Struct(t); !valid {
-		return val.ErrorFromMap(errMap)
+		return ErrorFromMap(t, errMap)
 	}
 	return nil
 }
@@ -56,6 +183,8 @@ func (t *Token) PreInsert(s gorp.SqlExecutor) error {
 	t.Created = milli.Timestamp(time.Now())
 	t.Updated = milli.Timestamp(time.Now())
 	t.Value = uniuri.NewLen(30)
+	t.Hash = hashToken(t.Value)
+	t.LastUsed = t.Created
 	ex := time.Now().AddDate(0, 0, 14)
 	t.Expiration = milli.Timestamp(ex)
 	return t.Validate()
@@ -70,3 +199,34 @@ func (t *Token) PostGet(s gorp.SqlExecutor) error {
 	t.ModelName = ModelNameToken
 	return nil
 }
+
+// CrudResource interface
+
+func (t *Token) TableName() string {
+	return TableNameToken
+}
+
+func (t *Token) TableId() int64 {
+	return t.ID
+}
+
+func (t *Token) Delete() {
+	t.Deleted = true
+}
+
+// CheckTokenSecret returns an error if the secret keying token hashes isn't
+// configured, since without it a leaked hash could be matched offline.
+func CheckTokenSecret() error {
+	if os.Getenv(tokenSecretEnv) == "" {
+		return fmt.Errorf("%s isn't configured", tokenSecretEnv)
+	}
+	return nil
+}
+
+// hashToken returns the keyed hash of value that is stored in place of the
+// value itself.
+func hashToken(value string) string {
+	mac := hmac.New(sha256.New, []byte(os.Getenv(tokenSecretEnv)))
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
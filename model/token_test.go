@@ -0,0 +1,146 @@
+package model
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/coopernurse/gorp"
+)
+
+// recordingDriver is a database/sql driver that accepts every statement
+// and records the arguments it was given.
+type recordingDriver struct {
+	args []driver.Value
+}
+
+func (d *recordingDriver) Open(name string) (driver.Conn, error) {
+	return &recordingConn{d}, nil
+}
+
+type recordingConn struct {
+	d *recordingDriver
+}
+
+func (c *recordingConn) Prepare(query string) (driver.Stmt, error) {
+	return &recordingStmt{c.d}, nil
+}
+
+func (c *recordingConn) Close() error {
+	return nil
+}
+
+func (c *recordingConn) Begin() (driver.Tx, error) {
+	return c, nil
+}
+
+func (c *recordingConn) Commit() error {
+	return nil
+}
+
+func (c *recordingConn) Rollback() error {
+	return nil
+}
+
+type recordingStmt struct {
+	d *recordingDriver
+}
+
+func (s *recordingStmt) Close() error {
+	return nil
+}
+
+func (s *recordingStmt) NumInput() int {
+	return -1
+}
+
+func (s *recordingStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.d.args = append(s.d.args, args...)
+	return recordingResult{}, nil
+}
+
+func (s *recordingStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, driver.ErrSkip
+}
+
+type recordingResult struct{}
+
+func (r recordingResult) LastInsertId() (int64, error) {
+	return 1, nil
+}
+
+func (r recordingResult) RowsAffected() (int64, error) {
+	return 1, nil
+}
+
+var tokenDriver = &recordingDriver{}
+
+func init() {
+	sql.Register("tokentest", tokenDriver)
+}
+
+func TestTokenValueIsNeverSaved(t *testing.T) {
+	os.Setenv(tokenSecretEnv, "test secret")
+	db, err := sql.Open("tokentest", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbmap := &gorp.DbMap{Db: db, Dialect: gorp.MySQLDialect{Engine: "InnoDB", Encoding: "UTF8"}}
+	dbmap.AddTableWithName(Token{}, TableNameToken).SetKeys(true, "ID")
+
+	tokenDriver.args = nil
+	token := &Token{MemberID: 1}
+	if err := dbmap.Insert(token); err != nil {
+		t.Fatal(err)
+	}
+	if token.Value == "" {
+		t.Fatal("the inserted token has no value to hand the client")
+	}
+
+	savedHash := false
+	for _, arg := range tokenDriver.args {
+		s, ok := arg.(string)
+		if !ok {
+			continue
+		}
+		if strings.Contains(s, token.Value) {
+			t.Errorf("the token's value was saved in %q", s)
+		}
+		if s == hashToken(token.Value) {
+			savedHash = true
+		}
+	}
+	if !savedHash {
+		t.Error("the token's hash wasn't saved")
+	}
+}
+
+func TestHashTokenIsKeyed(t *testing.T) {
+	os.Setenv(tokenSecretEnv, "one")
+	one := hashToken("value")
+	os.Setenv(tokenSecretEnv, "two")
+	two := hashToken("value")
+
+	if one == two {
+		t.Error("the hash doesn't depend on the secret")
+	}
+	if strings.Contains(one, "value") {
+		t.Error("the hash contains the value")
+	}
+	if two != hashToken("value") {
+		t.Error("the hash isn't deterministic")
+	}
+}
+
+func TestCheckTokenSecret(t *testing.T) {
+	os.Setenv(tokenSecretEnv, "")
+	if err := CheckTokenSecret(); err == nil {
+		t.Error("an unset secret was accepted")
+	}
+	os.Setenv(tokenSecretEnv, "secret")
+	if err := CheckTokenSecret(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,215 @@
+package model
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/coopernurse/gorp"
+	"github.com/dchest/uniuri"
+)
+
+const (
+	totpIssuer = "Mobile Main Street"
+	totpStep   = 30 * time.Second
+	totpDigits = 6
+
+	recoveryCodeCount = 10
+)
+
+var recoveryCodeChars = []byte("abcdefghjkmnpqrstuvwxyz23456789")
+
+// NewTOTPSecret returns a random base32 secret for an authenticator app.
+func NewTOTPSecret() string {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return strings.TrimRight(base32.StdEncoding.EncodeToString(b), "=")
+}
+
+// TOTPProvisioningURI returns the otpauth uri, usually shown as a QR code,
+// that adds secret to an authenticator app.
+func TOTPProvisioningURI(secret, email string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", totpIssuer)
+	label := url.QueryEscape(totpIssuer + ":" + email)
+	return fmt.Sprintf("otpauth://totp/%s?%s", strings.Replace(label, "+", "%20", -1), v.Encode())
+}
+
+// MatchTOTP returns true if code is the RFC 6238 code for secret at t or
+// one step either side of it, allowing for clock drift.  It also returns
+// the time step code is for, so a code can be refused once a code for the
+// same or a later step was used.
+func MatchTOTP(secret, code string, t time.Time) (int64, bool) {
+	code = strings.TrimSpace(code)
+	for _, skew := range []time.Duration{0, -totpStep, totpStep} {
+		expected, err := totpCode(secret, t.Add(skew))
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return totpCounter(t.Add(skew)), true
+		}
+	}
+	return 0, false
+}
+
+func totpCounter(t time.Time) int64 {
+	return t.Unix() / int64(totpStep/time.Second)
+}
+
+func totpCode(secret string, t time.Time) (string, error) {
+	padded := strings.ToUpper(secret)
+	if n := len(padded) % 8; n != 0 {
+		padded += strings.Repeat("=", 8-n)
+	}
+	key, err := base32.StdEncoding.DecodeString(padded)
+	if err != nil {
+		return "", err
+	}
+
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(totpCounter(t)))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+
+	// dynamic truncation from RFC 4226
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod), nil
+}
+
+// TwoFactorRequired returns true if the member must pass a TOTP challenge to
+// log in, either because they enabled it or because the community makes it
+// mandatory for organizers.
+func (m *Member) TwoFactorRequired(c *Community) bool {
+	return m.TOTPEnabled || (m.Organizer && c != nil && c.RequireOrganizerTwoFactor)
+}
+
+// StartTOTPEnrollment gives the member a new secret that isn't used until
+// ConfirmTOTPEnrollment checks a code from it.
+func (m *Member) StartTOTPEnrollment(s gorp.SqlExecutor) error {
+	m.TOTPSecret = NewTOTPSecret()
+	m.TOTPEnabled = false
+	m.RecoveryCodesRaw = ""
+	return m.saveTwoFactor(s)
+}
+
+// ConfirmTOTPEnrollment turns on two factor authentication with secret if
+// code is valid for it, setting the member's new recovery codes.  It
+// returns false if code isn't valid.
+func (m *Member) ConfirmTOTPEnrollment(s gorp.SqlExecutor, secret, code string) (bool, error) {
+	if secret == "" {
+		return false, nil
+	}
+	step, ok := MatchTOTP(secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+	if ok, err := m.useTOTPStep(s, step); !ok || err != nil {
+		return false, err
+	}
+
+	codes := []string{}
+	hashes := []string{}
+	for i := 0; i < recoveryCodeCount; i++ {
+		code := uniuri.NewLenChars(10, recoveryCodeChars)
+		codes = append(codes, code)
+		hashes = append(hashes, hashToken(code))
+	}
+	m.TOTPSecret = secret
+	m.TOTPEnabled = true
+	m.RecoveryCodesRaw = strings.Join(hashes, ",")
+	m.RecoveryCodes = codes
+	return true, m.saveTwoFactor(s)
+}
+
+// DisableTOTP turns off two factor authentication.
+func (m *Member) DisableTOTP(s gorp.SqlExecutor) error {
+	m.TOTPSecret = ""
+	m.TOTPEnabled = false
+	m.RecoveryCodesRaw = ""
+	return m.saveTwoFactor(s)
+}
+
+// CheckTwoFactor returns true if code is a current TOTP code for a later
+// step than the last one used, or an unused recovery code, either of which
+// it uses up.
+func (m *Member) CheckTwoFactor(s gorp.SqlExecutor, code string) (bool, error) {
+	if !m.TOTPEnabled {
+		return false, nil
+	}
+	if step, ok := MatchTOTP(m.TOTPSecret, code, time.Now()); ok {
+		return m.useTOTPStep(s, step)
+	}
+
+	hash := hashToken(strings.ToLower(strings.TrimSpace(code)))
+	hashes := sliceFromString(m.RecoveryCodesRaw)
+	for i, h := range hashes {
+		if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+			hashes = append(hashes[:i], hashes[i+1:]...)
+			return m.useRecoveryCodes(s, strings.Join(hashes, ","))
+		}
+	}
+	return false, nil
+}
+
+// useRecoveryCodes replaces the member's recovery codes with remaining, one
+// fewer, and returns false if they changed since the member was loaded.
+// Like useTOTPStep, the check and the write are one statement so two
+// requests can't both use the same code.
+func (m *Member) useRecoveryCodes(s gorp.SqlExecutor, remaining string) (bool, error) {
+	format := "update " + TableNameMember +
+		" set RecoveryCodesRaw = ? where ID = ? and RecoveryCodesRaw = ?"
+	res, err := s.Exec(format, remaining, m.ID, m.RecoveryCodesRaw)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil || n == 0 {
+		return false, err
+	}
+	m.RecoveryCodesRaw = remaining
+	return true, nil
+}
+
+// useTOTPStep records that a code for step was used and returns false if
+// one for step or a later step already was.  The check and the write are
+// one statement so two requests can't both use the same code.
+func (m *Member) useTOTPStep(s gorp.SqlExecutor, step int64) (bool, error) {
+	format := "update " + TableNameMember +
+		" set TOTPLastStep = ? where ID = ? and TOTPLastStep < ?"
+	res, err := s.Exec(format, step, m.ID, step)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil || n == 0 {
+		return false, err
+	}
+	m.TOTPLastStep = step
+	return true, nil
+}
+
+// saveTwoFactor writes the two factor columns directly so the rest of the
+// member, and its categories, aren't touched.
+func (m *Member) saveTwoFactor(s gorp.SqlExecutor) error {
+	format := "update " + TableNameMember +
+		" set TOTPSecret = ?, TOTPEnabled = ?, RecoveryCodesRaw = ? where ID = ?"
+	_, err := s.Exec(format, m.TOTPSecret, m.TOTPEnabled, m.RecoveryCodesRaw, m.ID)
+	return err
+}
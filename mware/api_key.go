@@ -0,0 +1,113 @@
+package mware
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/SyntropyDev/httperr"
+	"github.com/SyntropyDev/mms-api/model"
+)
+
+const (
+	apiKeyHeader = "X-API-Key"
+)
+
+// AuthScope is like Auth but also accepts an api key in the X-API-Key
+// header, as long as the key was granted scope.
+func AuthScope(scope string, h httperr.Handler) httperr.Handler {
+	auth := Auth(h)
+	return func(w http.ResponseWriter, r *http.Request) error {
+		value := r.Header.Get(apiKeyHeader)
+		if value == "" {
+			return auth(w, r)
+		}
+		return withAPIKey(w, r, value, scope, h)
+	}
+}
+
+// ReadScope leaves reads open to anyone, but a request sending an api key
+// in the X-API-Key header is refused unless the key was granted scope.
+func ReadScope(scope string, h httperr.Handler) httperr.Handler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		value := r.Header.Get(apiKeyHeader)
+		if value == "" {
+			return h(w, r)
+		}
+		return withAPIKey(w, r, value, scope, h)
+	}
+}
+
+// withAPIKey serves r with h as the api key value, if the key was granted
+// scope.
+func withAPIKey(w http.ResponseWriter, r *http.Request, value, scope string, h httperr.Handler) error {
+	dbmap, err := getDB()
+	defer dbmap.Db.Close()
+	if err != nil {
+		return err
+	}
+
+	key, err := model.FindAPIKey(dbmap, value)
+	if err != nil {
+		return errNotAuthorized()
+	}
+	if !key.HasScope(scope) {
+		return errForbidden()
+	}
+
+	setContext(r, &requestContext{apiKey: key})
+	defer clearContext(r)
+	return h(w, r)
+}
+
+// CreateAPIKeyHandler creates an api key owned by the authenticated
+// organizer.  The key itself is only ever included in this response.  It
+// must be wrapped by Auth and Organizer.
+func CreateAPIKeyHandler() httperr.Handler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+
+		type createAPIKeyReq struct {
+			Name       string
+			Scopes     []string
+			Expiration int64
+		}
+
+		req := &createAPIKeyReq{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			return httperr.New(http.StatusBadRequest, err.Error(), err)
+		}
+
+		dbmap, err := getDB()
+		defer dbmap.Db.Close()
+		if err != nil {
+			return err
+		}
+
+		member := CurrentMember(r)
+		if member == nil {
+			return errNotAuthorized()
+		}
+
+		key := &model.APIKey{
+			Name:       req.Name,
+			MemberID:   member.ID,
+			Scopes:     req.Scopes,
+			Expiration: req.Expiration,
+		}
+		trans, err := dbmap.Begin()
+		if err != nil {
+			return err
+		}
+		if err := trans.Insert(key); err != nil {
+			trans.Rollback()
+			return saveError(key, err)
+		}
+		if err := audit(trans, r, model.AuditActionCreate, key, nil, key); err != nil {
+			trans.Rollback()
+			return err
+		}
+		if err := trans.Commit(); err != nil {
+			return err
+		}
+		return json.NewEncoder(w).Encode(key)
+	}
+}
@@ -0,0 +1,26 @@
+package mware
+
+import (
+	"net/http"
+
+	"github.com/SyntropyDev/mms-api/model"
+	"github.com/coopernurse/gorp"
+)
+
+// audit records action on m by whoever authenticated r.  before and after
+// are the resource before and after the change, either may be nil.  Pass
+// the transaction making the change so the two are saved together.
+func audit(s gorp.SqlExecutor, r *http.Request, action string, m CrudResource, before, after interface{}) error {
+	actorType, actorID := model.ActorTypeMember, int64(0)
+	if key := CurrentAPIKey(r); key != nil {
+		actorType, actorID = model.ActorTypeAPIKey, key.ID
+	} else if member := CurrentMember(r); member != nil {
+		actorID = member.ID
+	}
+
+	event, err := model.NewAuditEvent(actorType, actorID, action, m.TableName(), m.TableId(), before, after)
+	if err != nil {
+		return err
+	}
+	return s.Insert(event)
+}
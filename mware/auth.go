@@ -4,16 +4,25 @@ import (
 	"encoding/json"
 	"errors"
 	"net/http"
+	"os"
+	"strings"
 
 	"github.com/SyntropyDev/httperr"
 	"github.com/SyntropyDev/mms-api/model"
 	"github.com/SyntropyDev/sqlutil"
-	"github.com/lann/squirrel"
+	"github.com/coopernurse/gorp"
 )
 
 const (
 	authEmailKey = "auth-email"
 	authTokenKey = "auth-token"
+
+	authHeader       = "Authorization"
+	authBearerPrefix = "Bearer "
+
+	// queryAuthEnv names the config switch that keeps the deprecated
+	// auth-email / auth-token query parameters working.
+	queryAuthEnv = "allowQueryAuth"
 )
 
 func Auth(h httperr.Handler) httperr.Handler {
@@ -24,21 +33,60 @@ func Auth(h httperr.Handler) httperr.Handler {
 			return err
 		}
 
-		v := r.URL.Query()
-		email := v.Get(authEmailKey)
-		token := v.Get(authTokenKey)
-
-		errResp := httperr.New(http.StatusUnauthorized, "not authorized", errors.New("not authorized"))
-		member, err := model.FindMember(dbmap, email)
+		member, token, err := authenticate(dbmap, w, r)
 		if err != nil {
-			return errResp
-		} else if err := model.ValidateToken(dbmap, member.ID, token); err != nil {
-			return errResp
+			return err
 		}
+
+		model.TouchToken(token)
+
+		setContext(r, &requestContext{member: member, token: token})
+		defer clearContext(r)
 		return h(w, r)
 	}
 }
 
+// authenticate resolves the member and token for the credentials in r.  A
+// bearer token in the Authorization header is preferred.  The auth-email and
+// auth-token query parameters are only accepted when the allowQueryAuth
+// config switch is on.
+func authenticate(s gorp.SqlExecutor, w http.ResponseWriter, r *http.Request) (*model.Member, *model.Token, error) {
+	if header := r.Header.Get(authHeader); header != "" {
+		if !strings.HasPrefix(header, authBearerPrefix) {
+			return nil, nil, errNotAuthorized()
+		}
+		value := strings.TrimSpace(strings.TrimPrefix(header, authBearerPrefix))
+		token, err := model.FindToken(s, value)
+		if err != nil {
+			return nil, nil, errNotAuthorized()
+		}
+		member := &model.Member{}
+		if err := sqlutil.SelectOneRelation(s, model.TableNameMember, token.MemberID, member); err != nil {
+			return nil, nil, errNotAuthorized()
+		}
+		if member.Deleted {
+			return nil, nil, errNotAuthorized()
+		}
+		return member, token, nil
+	}
+
+	if os.Getenv(queryAuthEnv) != "true" {
+		return nil, nil, errNotAuthorized()
+	}
+
+	v := r.URL.Query()
+	member, err := model.FindMember(s, v.Get(authEmailKey))
+	if err != nil {
+		return nil, nil, errNotAuthorized()
+	}
+	token, err := model.ValidateToken(s, member.ID, v.Get(authTokenKey))
+	if err != nil {
+		return nil, nil, errNotAuthorized()
+	}
+	w.Header().Set("Warning", `299 - "auth-email and auth-token are deprecated, use an Authorization header"`)
+	return member, token, nil
+}
+
 func LoginHandler() httperr.Handler {
 	return func(w http.ResponseWriter, r *http.Request) error {
 
@@ -58,15 +106,106 @@ func LoginHandler() httperr.Handler {
 			return err
 		}
 
+		ip := clientIP(r)
+		if err := checkIPLogin(ip); err != nil {
+			return withRetryAfter(w, err)
+		}
+
 		member, err := model.AuthenticateMember(dbmap, req.Email, req.Password)
+		if _, delayed := err.(*model.LoginDelayError); delayed {
+			return withRetryAfter(w, err)
+		} else if err != nil {
+			recordIPLogin(ip, false)
+			return err
+		}
+		recordIPLogin(ip, true)
+
+		return startSession(w, r, dbmap, member)
+	}
+}
+
+// newToken starts a session for member, remembering the device that
+// requested it.
+func newToken(s gorp.SqlExecutor, r *http.Request, member *model.Member) (*model.Token, error) {
+	token := &model.Token{
+		MemberID:  member.ID,
+		UserAgent: truncateRunes(r.UserAgent(), 255),
+		IP:        clientIP(r),
+	}
+	if err := s.Insert(token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// truncateRunes cuts s to at most n characters, the way varchar columns
+// count them, without splitting a multi-byte character.
+func truncateRunes(s string, n int) string {
+	count := 0
+	for i := range s {
+		if count == n {
+			return s[:i]
+		}
+		count++
+	}
+	return s
+}
+
+func LogoutHandler() httperr.Handler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		dbmap, err := getDB()
+		defer dbmap.Db.Close()
 		if err != nil {
 			return err
 		}
 
-		token := &model.Token{
-			MemberID: member.ID,
+		// logging out with credentials that are already invalid succeeds
+		_, token, err := authenticate(dbmap, w, r)
+		if err != nil {
+			return nil
+		}
+		if _, err := dbmap.Delete(token); err != nil {
+			return err
+		}
+		return nil
+	}
+}
+
+// RefreshTokenHandler trades the token used to authenticate the request for
+// a new one with a fresh expiration.  It must be wrapped by Auth.
+func RefreshTokenHandler() httperr.Handler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		dbmap, err := getDB()
+		defer dbmap.Db.Close()
+		if err != nil {
+			return err
+		}
+
+		member := CurrentMember(r)
+		old := currentToken(r)
+		if member == nil || old == nil {
+			return errNotAuthorized()
+		}
+
+		trans, err := dbmap.Begin()
+		if err != nil {
+			return err
+		}
+
+		token, err := newToken(trans, r, member)
+		if err != nil {
+			trans.Rollback()
+			return err
+		}
+		if _, err := trans.Delete(old); err != nil {
+			trans.Rollback()
+			return err
 		}
-		if err := dbmap.Insert(token); err != nil {
+		if err := audit(trans, r, model.AuditActionRefresh, token, old, token); err != nil {
+			trans.Rollback()
+			return err
+		}
+		if err := trans.Commit(); err != nil {
 			return err
 		}
 
@@ -75,7 +214,9 @@ func LoginHandler() httperr.Handler {
 	}
 }
 
-func LogoutHandler() httperr.Handler {
+// LogoutAllHandler deletes every token belonging to the authenticated member.
+// It must be wrapped by Auth.
+func LogoutAllHandler() httperr.Handler {
 	return func(w http.ResponseWriter, r *http.Request) error {
 		dbmap, err := getDB()
 		defer dbmap.Db.Close()
@@ -83,57 +224,208 @@ func LogoutHandler() httperr.Handler {
 			return err
 		}
 
-		tokenValue := r.URL.Query().Get(authTokenKey)
-		query := squirrel.Select("*").
-			From(model.TableNameToken).
-			Where(squirrel.Eq{"Value": tokenValue})
+		member := CurrentMember(r)
+		if member == nil {
+			return errNotAuthorized()
+		}
 
-		tokens := []*model.Token{}
-		if err := sqlutil.Select(dbmap, query, &tokens); err != nil {
+		trans, err := dbmap.Begin()
+		if err != nil {
 			return err
 		}
-		for _, token := range tokens {
-			dbmap.Delete(token)
+		if err := model.DeleteMemberTokens(trans, member.ID); err != nil {
+			trans.Rollback()
+			return err
 		}
-		return nil
+		if err := audit(trans, r, model.AuditActionRevoke, member, nil, nil); err != nil {
+			trans.Rollback()
+			return err
+		}
+		return trans.Commit()
+	}
+}
+
+// RequestInviteHandler registers a business member right away when the
+// community's registration policy is open, or queues the request for the
+// organizers when it is closed.
+func RequestInviteHandler() httperr.Handler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+
+		type requestInviteReq struct {
+			Name     string
+			Email    string
+			Password string
+		}
+
+		req := &requestInviteReq{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			return httperr.New(http.StatusBadRequest, err.Error(), err)
+		}
+
+		dbmap, err := getDB()
+		defer dbmap.Db.Close()
+		if err != nil {
+			return err
+		}
+
+		community, err := model.FindCommunity(dbmap)
+		if err != nil {
+			return err
+		}
+
+		pword, err := model.NewPassword(req.Password)
+		if err != nil {
+			return err
+		}
+
+		trans, err := dbmap.Begin()
+		if err != nil {
+			return err
+		}
+		member, reg, err := model.Register(trans, community, req.Name, req.Email, pword)
+		if err != nil {
+			trans.Rollback()
+			return saveError(&model.Member{}, err)
+		}
+		if err := trans.Commit(); err != nil {
+			return err
+		}
+
+		if member != nil {
+			if err := member.Welcome(); err != nil {
+				return err
+			}
+			return json.NewEncoder(w).Encode(member)
+		}
+		if err := reg.Notify(); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusAccepted)
+		return json.NewEncoder(w).Encode(reg)
+	}
+}
+
+// ApproveRegistrationHandler creates the member for a pending registration.
+// It must be wrapped by Auth and Organizer.
+func ApproveRegistrationHandler() httperr.Handler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		dbmap, err := getDB()
+		defer dbmap.Db.Close()
+		if err != nil {
+			return err
+		}
+
+		trans, err := dbmap.Begin()
+		if err != nil {
+			return err
+		}
+
+		reg := &model.Registration{}
+		if err := GetID(trans, reg, r.URL.Query().Get(":id")); err != nil {
+			trans.Rollback()
+			return err
+		}
+		before, err := model.Snapshot(reg)
+		if err != nil {
+			trans.Rollback()
+			return err
+		}
+		member, err := reg.Approve(trans)
+		if err != nil {
+			trans.Rollback()
+			return saveError(&model.Member{}, err)
+		}
+		if err := audit(trans, r, model.AuditActionApprove, reg, before, reg); err != nil {
+			trans.Rollback()
+			return err
+		}
+		if err := trans.Commit(); err != nil {
+			return err
+		}
+		if err := reg.Notify(); err != nil {
+			return err
+		}
+		return json.NewEncoder(w).Encode(member)
+	}
+}
+
+// RejectRegistrationHandler declines a pending registration.  It must be
+// wrapped by Auth and Organizer.
+func RejectRegistrationHandler() httperr.Handler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		dbmap, err := getDB()
+		defer dbmap.Db.Close()
+		if err != nil {
+			return err
+		}
+
+		trans, err := dbmap.Begin()
+		if err != nil {
+			return err
+		}
+
+		reg := &model.Registration{}
+		if err := GetID(trans, reg, r.URL.Query().Get(":id")); err != nil {
+			trans.Rollback()
+			return err
+		}
+		before, err := model.Snapshot(reg)
+		if err != nil {
+			trans.Rollback()
+			return err
+		}
+		if err := reg.Reject(trans); err != nil {
+			trans.Rollback()
+			return err
+		}
+		if err := audit(trans, r, model.AuditActionReject, reg, before, reg); err != nil {
+			trans.Rollback()
+			return err
+		}
+		if err := trans.Commit(); err != nil {
+			return err
+		}
+		if err := reg.Notify(); err != nil {
+			return err
+		}
+		return json.NewEncoder(w).Encode(reg)
 	}
 }
 
-// func RequestInviteHandler() httperr.Handler {
-// 	return func(w http.ResponseWriter, r *http.Request) error {
-
-// 		type requestInviteReq struct {
-// 			Name     string
-// 			Email    string
-// 			Password string
-// 		}
-
-// 		req := &requestInviteReq{}
-// 		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
-// 			return httperr.New(http.StatusBadRequest, err.Error(), err)
-// 		}
-
-// 		dbmap, err := getDB()
-// 		defer dbmap.Db.Close()
-// 		if err != nil {
-// 			return err
-// 		}
-
-// 		coms := []*model.Community{}
-// 		if _, err := dbmap.Select(&coms, "select * from communities"); err != nil {
-// 			return err
-// 		}
-// 		community := coms[0]
-
-// 		if community.RegistrationPolicy == model.RegistrationPolicyOpen {
-// 			member := &model.Member{
-// 				Email:    req.Email,
-// 				Password: req.Password,
-// 			}
-// 		}
-// 		return nil
-// 	}
-// }
+// UnlockMemberHandler clears the failed logins and lockout of a member.  It
+// must be wrapped by Auth and Organizer.
+func UnlockMemberHandler() httperr.Handler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		dbmap, err := getDB()
+		defer dbmap.Db.Close()
+		if err != nil {
+			return err
+		}
+
+		trans, err := dbmap.Begin()
+		if err != nil {
+			return err
+		}
+
+		member := &model.Member{}
+		if err := GetID(trans, member, r.URL.Query().Get(":id")); err != nil {
+			trans.Rollback()
+			return err
+		}
+		if err := model.UnlockMember(trans, member.ID); err != nil {
+			trans.Rollback()
+			return err
+		}
+		if err := audit(trans, r, model.AuditActionUnlock, member, nil, nil); err != nil {
+			trans.Rollback()
+			return err
+		}
+		if err := trans.Commit(); err != nil {
+			return err
+		}
+		return json.NewEncoder(w).Encode(member)
+	}
+}
 
 func InviteHandler() httperr.Handler {
 	return func(w http.ResponseWriter, r *http.Request) error {
@@ -153,15 +445,40 @@ func InviteHandler() httperr.Handler {
 			return err
 		}
 
+		trans, err := dbmap.Begin()
+		if err != nil {
+			return err
+		}
+
 		member := &model.Member{}
-		if err := sqlutil.SelectOneRelation(dbmap, model.TableNameMember, req.MemberID, member); err != nil {
+		if err := sqlutil.SelectOneRelation(trans, model.TableNameMember, req.MemberID, member); err != nil {
+			trans.Rollback()
 			return httperr.New(http.StatusBadRequest, "member not found", err)
 		}
-		member.SetPassword(model.NewAutoPassword())
+		before, err := model.Snapshot(member)
+		if err != nil {
+			trans.Rollback()
+			return err
+		}
+		pword, err := model.NewAutoPassword()
+		if err != nil {
+			trans.Rollback()
+			return err
+		}
+		member.SetPassword(pword)
 		member.Email = req.Email
-		if _, err := dbmap.Update(member); err != nil {
+		if _, err := trans.Update(member); err != nil {
+			trans.Rollback()
+			return err
+		}
+		if err := audit(trans, r, model.AuditActionInvite, member, before, member); err != nil {
+			trans.Rollback()
+			return err
+		}
+		if err := trans.Commit(); err != nil {
 			return err
 		}
+		// only email a password once it's saved
 		if err := member.Invite(req.Email); err != nil {
 			return err
 		}
@@ -212,7 +529,8 @@ func SignupHandler() httperr.Handler {
 		}
 		pword, err := model.NewPassword(req.Password)
 		if err != nil {
-			return httperr.New(http.StatusBadRequest, "password must be between 7 and 32 characters", err)
+			trans.Rollback()
+			return err
 		}
 		member.SetPassword(pword)
 
@@ -271,13 +589,49 @@ func ResetPasswordHandler() httperr.Handler {
 		if err != nil {
 			return nil
 		}
-		if err := member.ResetPassword(); err != nil {
+		return member.ResetPassword(dbmap)
+	}
+}
+
+func ConfirmResetPasswordHandler() httperr.Handler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+
+		type confirmResetPasswordReq struct {
+			Token    string
+			Password string
+		}
+
+		req := &confirmResetPasswordReq{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			return httperr.New(http.StatusBadRequest, err.Error(), err)
+		}
+
+		dbmap, err := getDB()
+		defer dbmap.Db.Close()
+		if err != nil {
 			return err
 		}
-		if _, err := dbmap.Update(member); err != nil {
+
+		trans, err := dbmap.Begin()
+		if err != nil {
 			return err
 		}
-		return nil
+		member, err := model.ConfirmPasswordReset(trans, req.Token, req.Password)
+		if err != nil {
+			trans.Rollback()
+			return err
+		}
+		// the link authenticates the member for the audit
+		setContext(r, &requestContext{member: member})
+		defer clearContext(r)
+		if err := audit(trans, r, model.AuditActionResetPassword, member, nil, nil); err != nil {
+			trans.Rollback()
+			return err
+		}
+		if err := trans.Commit(); err != nil {
+			return err
+		}
+		return json.NewEncoder(w).Encode(member)
 	}
 }
 
@@ -300,10 +654,9 @@ func ChangePasswordHandler() httperr.Handler {
 			return err
 		}
 
-		email := r.URL.Query().Get(authEmailKey)
-		member, err := model.FindMember(dbmap, email)
-		if err != nil {
-			return err
+		member := CurrentMember(r)
+		if member == nil {
+			return errNotAuthorized()
 		}
 
 		if !member.HasPassword(req.OldPassword) {
@@ -313,12 +666,26 @@ func ChangePasswordHandler() httperr.Handler {
 
 		pword, err := model.NewPassword(req.NewPassword)
 		if err != nil {
-			return httperr.New(http.StatusBadRequest, "password must be between 7 and 32 characters", err)
+			return err
+		}
+		before, err := model.Snapshot(member)
+		if err != nil {
+			return err
 		}
 		member.SetPassword(pword)
-		if _, err := dbmap.Update(member); err != nil {
+
+		trans, err := dbmap.Begin()
+		if err != nil {
 			return err
 		}
-		return nil
+		if _, err := trans.Update(member); err != nil {
+			trans.Rollback()
+			return err
+		}
+		if err := audit(trans, r, model.AuditActionChangePassword, member, before, member); err != nil {
+			trans.Rollback()
+			return err
+		}
+		return trans.Commit()
 	}
 }
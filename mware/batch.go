@@ -0,0 +1,207 @@
+package mware
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/SyntropyDev/httperr"
+	"github.com/SyntropyDev/mms-api/model"
+	"github.com/coopernurse/gorp"
+)
+
+const (
+	batchCreate = "create"
+	batchUpdate = "update"
+	batchDelete = "delete"
+
+	// batchMaxItemsEnv names the config value limiting the items in one
+	// batch.
+	batchMaxItemsEnv     = "batchMaxItems"
+	defaultBatchMaxItems = 500
+)
+
+// batchItem is one create, update or delete in a batch.  Updates and
+// deletes name the row by ID, creates and updates carry its json in Data.
+type batchItem struct {
+	Op   string          `json:"op"`
+	ID   int64           `json:"id"`
+	Data json.RawMessage `json:"data"`
+}
+
+type batchResult struct {
+	Status int         `json:"status"`
+	Data   interface{} `json:"data,omitempty"`
+}
+
+// batchResp holds a result for each item in the order they were sent, and
+// an error for each failed item keyed by its index.
+type batchResp struct {
+	Results []*batchResult       `json:"results,omitempty"`
+	Errors  map[string]*apiError `json:"errors,omitempty"`
+}
+
+// Batch creates, updates and deletes many resources of m's type in one
+// call.  By default every item runs in one transaction that is rolled back
+// if any item fails, in which case only the errors are returned.  With
+// atomic set to false each item runs in its own transaction and the
+// results report which succeeded, with a 207 status if only some did and
+// a 400 if none did.
+func Batch(m CrudResource) httperr.Handler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+
+		type batchReq struct {
+			Atomic *bool
+			Items  []*batchItem
+		}
+
+		req := &batchReq{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			return clientError(err)
+		}
+		max := model.ConfigInt(batchMaxItemsEnv, defaultBatchMaxItems)
+		if len(req.Items) > max {
+			err := fmt.Errorf("batch has more than %d items", max)
+			return httperr.New(http.StatusRequestEntityTooLarge, err.Error(), err)
+		}
+		atomic := req.Atomic == nil || *req.Atomic
+
+		dbmap, err := getDB()
+		defer dbmap.Db.Close()
+		if err != nil {
+			return err
+		}
+
+		resp := &batchResp{
+			Results: make([]*batchResult, len(req.Items)),
+			Errors:  map[string]*apiError{},
+		}
+
+		if !atomic {
+			for i, item := range req.Items {
+				trans, err := dbmap.Begin()
+				if err != nil {
+					return err
+				}
+				result, err := runBatchItem(trans, r, m, item)
+				if err != nil {
+					trans.Rollback()
+					resp.Results[i], resp.Errors[strconv.Itoa(i)] = newBatchError(r, err)
+					continue
+				}
+				if err := trans.Commit(); err != nil {
+					resp.Results[i], resp.Errors[strconv.Itoa(i)] = newBatchError(r, err)
+					continue
+				}
+				resp.Results[i] = result
+			}
+			switch {
+			case len(resp.Errors) == 0:
+			case len(resp.Errors) == len(req.Items):
+				w.WriteHeader(http.StatusBadRequest)
+			default:
+				w.WriteHeader(207)
+			}
+			return json.NewEncoder(w).Encode(resp)
+		}
+
+		trans, err := dbmap.Begin()
+		if err != nil {
+			return err
+		}
+		// keep going after a failure so every bad item is reported at once
+		status := http.StatusBadRequest
+		for i, item := range req.Items {
+			result, err := runBatchItem(trans, r, m, item)
+			if err != nil {
+				var e *apiError
+				resp.Results[i], e = newBatchError(r, err)
+				resp.Errors[strconv.Itoa(i)] = e
+				if e.Status >= http.StatusInternalServerError {
+					status = e.Status
+				}
+				continue
+			}
+			resp.Results[i] = result
+		}
+
+		if len(resp.Errors) > 0 {
+			trans.Rollback()
+			resp.Results = nil
+			w.WriteHeader(status)
+			return json.NewEncoder(w).Encode(resp)
+		}
+		if err := trans.Commit(); err != nil {
+			return err
+		}
+		return json.NewEncoder(w).Encode(resp)
+	}
+}
+
+func runBatchItem(s gorp.SqlExecutor, r *http.Request, m CrudResource, item *batchItem) (*batchResult, error) {
+	result, err := applyBatchItem(s, r, m, item)
+	if err != nil {
+		return nil, err
+	}
+	if err := expand(s, r, result.Data.(CrudResource)); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func applyBatchItem(s gorp.SqlExecutor, r *http.Request, m CrudResource, item *batchItem) (*batchResult, error) {
+	mCopy := copyResource(m)
+
+	switch item.Op {
+	case batchCreate:
+		if err := decodeBatchData(item, mCopy); err != nil {
+			return nil, err
+		}
+		if err := createResource(s, r, mCopy); err != nil {
+			return nil, err
+		}
+		return &batchResult{Status: http.StatusCreated, Data: mCopy}, nil
+	case batchUpdate, batchDelete:
+		if err := lockID(s, mCopy, item.ID); err != nil {
+			return nil, err
+		}
+		if err := authorize(r, mCopy); err != nil {
+			return nil, err
+		}
+		if item.Op == batchDelete {
+			if err := deleteResource(s, r, mCopy); err != nil {
+				return nil, err
+			}
+			return &batchResult{Status: http.StatusOK, Data: mCopy}, nil
+		}
+
+		updateCopy := copyResource(m)
+		if err := decodeBatchData(item, updateCopy); err != nil {
+			return nil, err
+		}
+		if err := updateResource(s, r, mCopy, updateCopy); err != nil {
+			return nil, err
+		}
+		return &batchResult{Status: http.StatusOK, Data: mCopy}, nil
+	}
+
+	err := fmt.Errorf("op must be %s, %s or %s", batchCreate, batchUpdate, batchDelete)
+	return nil, httperr.New(http.StatusBadRequest, err.Error(), err)
+}
+
+func decodeBatchData(item *batchItem, m CrudResource) error {
+	if err := json.NewDecoder(bytes.NewReader(item.Data)).Decode(m); err != nil {
+		message := fmt.Sprintf("%s's json could not parsed.", m.TableName())
+		return httperr.New(http.StatusBadRequest, message, err)
+	}
+	return nil
+}
+
+// newBatchError returns the result and error reported for an item that
+// failed with err.
+func newBatchError(r *http.Request, err error) (*batchResult, *apiError) {
+	e := newAPIError(r, err)
+	return &batchResult{Status: e.Status}, e
+}
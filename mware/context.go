@@ -0,0 +1,90 @@
+package mware
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/SyntropyDev/mms-api/model"
+)
+
+// requestContext holds the values Auth resolves for a request so the
+// handlers it wraps can read them.
+type requestContext struct {
+	member *model.Member
+	token  *model.Token
+	apiKey *model.APIKey
+}
+
+var (
+	contextMu sync.Mutex
+	contexts  = map[*http.Request]*requestContext{}
+)
+
+// CurrentMember returns the member authenticated for r, or nil if the
+// request wasn't authenticated.
+func CurrentMember(r *http.Request) *model.Member {
+	contextMu.Lock()
+	defer contextMu.Unlock()
+	if c, ok := contexts[r]; ok {
+		return c.member
+	}
+	return nil
+}
+
+// CurrentAPIKey returns the api key that authenticated r, or nil if the
+// request wasn't authenticated with one.
+func CurrentAPIKey(r *http.Request) *model.APIKey {
+	contextMu.Lock()
+	defer contextMu.Unlock()
+	if c, ok := contexts[r]; ok {
+		return c.apiKey
+	}
+	return nil
+}
+
+// currentToken returns the token used to authenticate r, or nil if the
+// request wasn't authenticated.
+func currentToken(r *http.Request) *model.Token {
+	contextMu.Lock()
+	defer contextMu.Unlock()
+	if c, ok := contexts[r]; ok {
+		return c.token
+	}
+	return nil
+}
+
+func setContext(r *http.Request, c *requestContext) {
+	contextMu.Lock()
+	defer contextMu.Unlock()
+	contexts[r] = c
+}
+
+func clearContext(r *http.Request) {
+	contextMu.Lock()
+	defer contextMu.Unlock()
+	delete(contexts, r)
+}
+
+var (
+	requestIDs = map[*http.Request]string{}
+)
+
+// RequestID returns the id given to r, which is sent back in the
+// X-Request-ID header and logged with internal errors.
+func RequestID(r *http.Request) string {
+	contextMu.Lock()
+	defer contextMu.Unlock()
+	return requestIDs[r]
+}
+
+func setRequestID(r *http.Request, id string) {
+	contextMu.Lock()
+	defer contextMu.Unlock()
+	requestIDs[r] = id
+}
+
+func clearRequestID(r *http.Request) {
+	contextMu.Lock()
+	defer contextMu.Unlock()
+	delete(requestIDs, r)
+}
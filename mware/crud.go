@@ -2,22 +2,37 @@ package mware
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
 	"reflect"
+	"regexp"
 	"strings"
 
 	"github.com/SyntropyDev/httperr"
 	"github.com/SyntropyDev/merge"
-	"github.com/SyntropyDev/querystr"
+	"github.com/SyntropyDev/mms-api/model"
 	"github.com/SyntropyDev/sqlutil"
 	"github.com/coopernurse/gorp"
+	"github.com/go-sql-driver/mysql"
 	"github.com/lann/squirrel"
 )
 
 const (
-	KeyFields = "q-fields"
+	KeyFields   = "q-fields"
+	KeyEnvelope = "q-envelope"
+	KeyExpand   = "q-expand"
+
+	mysqlDuplicateEntry  = 1062
+	mysqlNoReferencedRow = 1452
+)
+
+var (
+	// the column is named by the key in a duplicate entry error and by the
+	// constraint in a foreign key one
+	duplicateKeyRe = regexp.MustCompile(`for key '([^']+)'`)
+	foreignKeyRe   = regexp.MustCompile("FOREIGN KEY \\(`([^`]+)`\\)")
 )
 
 type CrudResource interface {
@@ -47,17 +62,38 @@ func GetAll(m CrudResource) httperr.Handler {
 		}
 
 		values := r.URL.Query()
-		sql, args, err := querystr.Query(m, m.TableName(), values)
+		format, err := listFormat(r)
 		if err != nil {
-			return clientError(err)
+			return err
+		}
+		q, err := newListQuery(m, values)
+		if err != nil {
+			return err
+		}
+		include, err := includeDeleted(dbmap, w, r)
+		if err != nil {
+			return err
+		}
+		if _, ok := structField(m, "Deleted"); ok && !include {
+			q.where("Deleted = ?", false)
+		}
+		if format != formatJSON {
+			return export(w, r, dbmap, m, q, format)
+		}
+		sql, args, err := q.ToSql()
+		if err != nil {
+			return err
 		}
 
 		models, err := dbmap.Select(m, sql, args...)
 		if err != nil {
-			return clientError(err)
+			return err
+		}
+		if err := model.Expand(dbmap, models, expandRelations(values)); err != nil {
+			return err
 		}
 
-		return getAllWriteJSON(w, values, models)
+		return writeList(w, r, dbmap, q, models)
 	}
 }
 
@@ -74,7 +110,25 @@ func GetByID(m CrudResource) httperr.Handler {
 		if err := GetID(dbmap, mCopy, id); err != nil {
 			return err
 		}
+		if isDeleted(mCopy) {
+			include, err := includeDeleted(dbmap, w, r)
+			if err != nil {
+				return err
+			}
+			if !include {
+				message := fmt.Sprintf("Could not find %s.", m.TableName())
+				return httperr.New(http.StatusNotFound, message, errors.New(message))
+			}
+		}
 
+		if err := expand(dbmap, r, mCopy); err != nil {
+			return err
+		}
+		setValidators(w, r, mCopy)
+		if notModified(r, mCopy) {
+			w.WriteHeader(http.StatusNotModified)
+			return nil
+		}
 		return json.NewEncoder(w).Encode(mCopy)
 	}
 }
@@ -87,24 +141,28 @@ func Create(m CrudResource) httperr.Handler {
 			return err
 		}
 
-		trans, err := dbmap.Begin()
-		if err != nil {
-			return err
-		}
-
 		mCopy := copyResource(m)
 		if err := json.NewDecoder(r.Body).Decode(mCopy); err != nil {
 			return clientError(err)
 		}
 
-		if err := trans.Insert(mCopy); err != nil {
-			message := fmt.Sprintf("%s did not pass validation.", m.TableName())
-			return httperr.New(http.StatusBadRequest, message, err)
+		trans, err := dbmap.Begin()
+		if err != nil {
+			return err
+		}
+		if err := createResource(trans, r, mCopy); err != nil {
+			trans.Rollback()
+			return err
+		}
+		if err := expand(trans, r, mCopy); err != nil {
+			trans.Rollback()
+			return err
 		}
 
 		if err := trans.Commit(); err != nil {
 			return err
 		}
+		setValidators(w, r, mCopy)
 		return json.NewEncoder(w).Encode(mCopy)
 	}
 }
@@ -117,25 +175,45 @@ func UpdateByID(m CrudResource) httperr.Handler {
 			return err
 		}
 
+		trans, err := dbmap.Begin()
+		if err != nil {
+			return err
+		}
+
 		id := r.URL.Query().Get(":id")
 		mCopy := copyResource(m)
-		if err := GetID(dbmap, mCopy, id); err != nil {
+		if err := lockID(trans, mCopy, id); err != nil {
+			trans.Rollback()
+			return err
+		}
+		if err := authorize(r, mCopy); err != nil {
+			trans.Rollback()
+			return err
+		}
+		if err := checkIfMatch(r, mCopy); err != nil {
+			trans.Rollback()
 			return err
 		}
 
 		updateCopy := copyResource(m)
 		if err := json.NewDecoder(r.Body).Decode(updateCopy); err != nil {
+			trans.Rollback()
 			message := fmt.Sprintf("%s's json could not parsed.", m.TableName())
 			return httperr.New(http.StatusBadRequest, message, err)
 		}
-
-		merge.TagWl(updateCopy, mCopy)
-
-		if _, err := dbmap.Update(mCopy); err != nil {
-			message := fmt.Sprintf("%s did not pass validation.", m.TableName())
-			return httperr.New(http.StatusBadRequest, message, err)
+		if err := updateResource(trans, r, mCopy, updateCopy); err != nil {
+			trans.Rollback()
+			return err
+		}
+		if err := expand(trans, r, mCopy); err != nil {
+			trans.Rollback()
+			return err
 		}
 
+		if err := trans.Commit(); err != nil {
+			return err
+		}
+		setValidators(w, r, mCopy)
 		return json.NewEncoder(w).Encode(mCopy)
 	}
 }
@@ -148,36 +226,199 @@ func DeleteByID(m CrudResource) httperr.Handler {
 			return err
 		}
 
+		trans, err := dbmap.Begin()
+		if err != nil {
+			return err
+		}
+
 		id := r.URL.Query().Get(":id")
 		mCopy := copyResource(m)
-		if err := GetID(dbmap, mCopy, id); err != nil {
+		if err := lockID(trans, mCopy, id); err != nil {
+			trans.Rollback()
 			return err
 		}
-
-		mCopy.Delete()
-
-		if _, err := dbmap.Update(mCopy); nil != err {
+		if err := authorize(r, mCopy); err != nil {
+			trans.Rollback()
+			return err
+		}
+		if err := checkIfMatch(r, mCopy); err != nil {
+			trans.Rollback()
+			return err
+		}
+		if err := deleteResource(trans, r, mCopy); err != nil {
+			trans.Rollback()
+			return err
+		}
+		if err := expand(trans, r, mCopy); err != nil {
+			trans.Rollback()
 			return err
 		}
 
+		if err := trans.Commit(); err != nil {
+			return err
+		}
+		setValidators(w, r, mCopy)
 		return json.NewEncoder(w).Encode(mCopy)
 	}
 }
 
-func GetID(dbmap *gorp.DbMap, m CrudResource, id interface{}) error {
+// expand embeds the relations listed in r's q-expand in m, along with
+// whatever m's type always embeds, so every response that returns one
+// resource has the same shape as GetByID's.
+func expand(s gorp.SqlExecutor, r *http.Request, m CrudResource) error {
+	return model.Expand(s, []interface{}{m}, expandRelations(r.URL.Query()))
+}
+
+// expandRelations returns the relations listed in q-expand.
+func expandRelations(values url.Values) []string {
+	relations := []string{}
+	for _, rel := range strings.Split(values.Get(KeyExpand), ",") {
+		if rel = strings.TrimSpace(rel); rel != "" {
+			relations = append(relations, rel)
+		}
+	}
+	return relations
+}
+
+// createResource inserts m, once the authenticated member is allowed to,
+// and records it in the audit log.  Any ID sent by the client is cleared
+// first, since the insert ignores it and a member could otherwise claim
+// to own a new member by sending their own.
+func createResource(s gorp.SqlExecutor, r *http.Request, m CrudResource) error {
+	if id := reflect.ValueOf(m).Elem().FieldByName("ID"); id.IsValid() && id.Kind() == reflect.Int64 {
+		id.SetInt(0)
+	}
+	if err := authorize(r, m); err != nil {
+		return err
+	}
+	if err := s.Insert(m); err != nil {
+		return saveError(m, err)
+	}
+	return audit(s, r, model.AuditActionCreate, m, nil, m)
+}
+
+// updateResource merges the merge:"true" fields of update into m, which
+// the caller has already loaded and authorized, then saves and audits it.
+// Deleted isn't mergeable on resources with a restore route, so they're
+// only deleted by deleteResource, which revokes a member's credentials.
+func updateResource(s gorp.SqlExecutor, r *http.Request, m, update CrudResource) error {
+	before, err := model.Snapshot(m)
+	if err != nil {
+		return err
+	}
+
+	merge.TagWl(update, m)
+
+	// prevent members from handing their resources to someone else
+	if err := authorize(r, m); err != nil {
+		return err
+	}
+
+	if _, err := s.Update(m); err != nil {
+		return saveError(m, err)
+	}
+	return audit(s, r, model.AuditActionUpdate, m, before, m)
+}
+
+// credentialRevoker is implemented by resources that hold credentials which
+// must stop working when they're deleted.
+type credentialRevoker interface {
+	RevokeCredentials(s gorp.SqlExecutor) error
+}
+
+// deleteResource soft deletes m, which the caller has already loaded and
+// authorized, and audits it.
+func deleteResource(s gorp.SqlExecutor, r *http.Request, m CrudResource) error {
+	before, err := model.Snapshot(m)
+	if err != nil {
+		return err
+	}
+
+	m.Delete()
+
+	if _, err := s.Update(m); err != nil {
+		return err
+	}
+	if revoker, ok := m.(credentialRevoker); ok {
+		if err := revoker.RevokeCredentials(s); err != nil {
+			return err
+		}
+	}
+	return audit(s, r, model.AuditActionDelete, m, before, m)
+}
+
+func GetID(s gorp.SqlExecutor, m CrudResource, id interface{}) error {
 	query := squirrel.Select("*").
 		From(m.TableName()).
 		Where(squirrel.Eq{"ID": id})
-	if err := sqlutil.SelectOne(dbmap, query, m); err != nil {
+	return selectID(s, m, query)
+}
+
+// lockID is GetID for a row about to be changed.  The row stays locked
+// until the transaction s ends, so a concurrent change can't slip in
+// between checking its version and writing it.
+func lockID(s gorp.SqlExecutor, m CrudResource, id interface{}) error {
+	query := squirrel.Select("*").
+		From(m.TableName()).
+		Where(squirrel.Eq{"ID": id}).
+		Suffix("FOR UPDATE")
+	return selectID(s, m, query)
+}
+
+func selectID(s gorp.SqlExecutor, m CrudResource, query squirrel.SelectBuilder) error {
+	if err := sqlutil.SelectOne(s, query, m); err != nil {
 		message := fmt.Sprintf("Could not find %s.", m.TableName())
 		return httperr.New(http.StatusNotFound, message, err)
 	}
 	return nil
 }
 
+// saveError returns the error for a failed insert or update of m.  Errors
+// from the model's hooks, like failed validation with its fields, are kept.
+// Unique and foreign key violations are reported against their column, and
+// anything else is returned as is to be logged as an internal error.
+func saveError(m CrudResource, err error) error {
+	if _, ok := err.(httperr.Error); ok {
+		return err
+	}
+	mErr, ok := err.(*mysql.MySQLError)
+	if !ok {
+		return err
+	}
+	switch mErr.Number {
+	case mysqlDuplicateEntry:
+		if match := duplicateKeyRe.FindStringSubmatch(mErr.Message); match != nil {
+			// newer versions of mysql qualify the key with its table
+			key := match[1][strings.LastIndex(match[1], ".")+1:]
+			fields := map[string]string{columnKey(m, key): "is already taken"}
+			message := fmt.Sprintf("%s conflicts with an existing one.", m.TableName())
+			return model.NewFieldsError(http.StatusConflict, message, fields)
+		}
+	case mysqlNoReferencedRow:
+		if match := foreignKeyRe.FindStringSubmatch(mErr.Message); match != nil {
+			fields := map[string]string{columnKey(m, match[1]): "does not exist"}
+			message := fmt.Sprintf("%s did not pass validation.", m.TableName())
+			return model.NewFieldsError(http.StatusBadRequest, message, fields)
+		}
+	}
+	return err
+}
+
+// columnKey returns the json key of m's field for column, or if m has no
+// such field, like for a column of a join table, column in lower camel case.
+func columnKey(m CrudResource, column string) string {
+	if field, ok := reflect.TypeOf(m).Elem().FieldByName(column); ok {
+		if key := getJsonKeyFromTag(field.Tag.Get("json")); key != "-" && key != "" {
+			return key
+		}
+	}
+	return strings.ToLower(column[:1]) + column[1:]
+}
+
+// clientError reports a request the client got wrong, like a body that
+// isn't json, with the cause as the message.
 func clientError(err error) error {
-	message := "Problem performing request.  Please alert the Account owner if the problem continues."
-	return httperr.New(http.StatusBadRequest, message, err)
+	return httperr.New(http.StatusBadRequest, err.Error(), err)
 }
 
 func copyResource(m CrudResource) CrudResource {
@@ -197,9 +438,75 @@ func getJsonKeyFromTag(tag string) string {
 	return "-"
 }
 
+// listEnvelope wraps a page of results when the client asks for it with
+// q-envelope=true.
+type listEnvelope struct {
+	Data       interface{} `json:"data"`
+	Total      int64       `json:"total"`
+	NextCursor *string     `json:"nextCursor"`
+}
+
+// writeList writes a page of models selected by q.  Links to the first and
+// next pages are sent in the Link header, and the envelope adds the total
+// count and the next page's cursor.
+func writeList(w http.ResponseWriter, r *http.Request, s gorp.SqlExecutor, q *listQuery, models []interface{}) error {
+	values := r.URL.Query()
+	models, next := q.page(models)
+
+	links := []string{fmt.Sprintf(`<%s>; rel="first"`, pageURL(r, ""))}
+	if next != "" {
+		links = append(links, fmt.Sprintf(`<%s>; rel="next"`, pageURL(r, next)))
+	}
+	w.Header().Set("Link", strings.Join(links, ", "))
+	w.Header().Add("Access-Control-Expose-Headers", "Link")
+
+	if values.Get(KeyEnvelope) != "true" {
+		return getAllWriteJSON(w, values, models)
+	}
+
+	total, err := q.count(s)
+	if err != nil {
+		return err
+	}
+	env := &listEnvelope{
+		Data:  selectFields(values, models),
+		Total: total,
+	}
+	if next != "" {
+		env.NextCursor = &next
+	}
+	return json.NewEncoder(w).Encode(env)
+}
+
+// pageURL returns the request's url starting from cursor instead of its own
+// page.
+func pageURL(r *http.Request, cursor string) string {
+	values := url.Values{}
+	for k, v := range r.URL.Query() {
+		// skip the route parameters pat adds
+		if strings.HasPrefix(k, ":") {
+			continue
+		}
+		values[k] = v
+	}
+	values.Del(KeyOffset)
+	values.Del(KeyCursor)
+	if cursor != "" {
+		values.Set(KeyCursor, cursor)
+	}
+
+	u := url.URL{Path: r.URL.Path, RawQuery: values.Encode()}
+	return u.String()
+}
+
 func getAllWriteJSON(w http.ResponseWriter, values url.Values, models []interface{}) error {
+	return json.NewEncoder(w).Encode(selectFields(values, models))
+}
+
+// selectFields returns models limited to the json keys listed in q-fields.
+func selectFields(values url.Values, models []interface{}) interface{} {
 	if len(models) == 0 || values.Get(KeyFields) == "" {
-		return json.NewEncoder(w).Encode(models)
+		return models
 	}
 
 	paramFields := strings.Split(values.Get(KeyFields), ",")
@@ -232,6 +539,5 @@ func getAllWriteJSON(w http.ResponseWriter, values url.Values, models []interfac
 		}
 		slimModels = append(slimModels, modelMap)
 	}
-
-	return json.NewEncoder(w).Encode(slimModels)
+	return slimModels
 }
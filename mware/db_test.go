@@ -0,0 +1,266 @@
+package mware
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/SyntropyDev/mms-api/model"
+	"github.com/coopernurse/gorp"
+)
+
+// memDriver is a database/sql driver keeping rows in memory, enough to run
+// handlers in tests.  It understands the inserts and updates gorp writes
+// and selects of every column filtered by equality; other conditions and
+// statements are accepted and ignored.
+type memDriver struct {
+	mu     sync.Mutex
+	tables map[string]*memTable
+	lastID int64
+}
+
+type memTable struct {
+	columns []string
+	rows    []map[string]driver.Value
+}
+
+var (
+	memDB = &memDriver{}
+
+	insertRe    = regexp.MustCompile("^insert into `?(\\w+)`? \\((.*?)\\) values \\((.*?)\\)")
+	updateRe    = regexp.MustCompile("^update `?(\\w+)`? set (.*) where `?ID`?=\\?")
+	selectRe    = regexp.MustCompile(`(?i)^select \* from (\w+)(?: where (.*))?`)
+	conditionRe = regexp.MustCompile(`(\w+) (=|<>|!=|<|<=|>|>=) \?`)
+)
+
+func init() {
+	sql.Register("memtest", memDB)
+}
+
+// reset empties the database.
+func (d *memDriver) reset() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.tables = map[string]*memTable{}
+}
+
+// rows returns the rows of table.
+func (d *memDriver) rows(table string) []map[string]driver.Value {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if t, ok := d.tables[table]; ok {
+		return t.rows
+	}
+	return nil
+}
+
+// memDbMap opens the in memory database with the tables the handlers
+// insert and update.  Each call is a new connection, like getDB.
+func memDbMap() (*gorp.DbMap, error) {
+	db, err := sql.Open("memtest", "")
+	if err != nil {
+		return nil, err
+	}
+	dbmap := &gorp.DbMap{Db: db, Dialect: gorp.MySQLDialect{Engine: "InnoDB", Encoding: "UTF8"}}
+	dbmap.AddTableWithName(model.Member{}, model.TableNameMember).SetKeys(true, "ID")
+	dbmap.AddTableWithName(model.Feed{}, model.TableNameFeed).SetKeys(true, "ID")
+	dbmap.AddTableWithName(model.Token{}, model.TableNameToken).SetKeys(true, "ID")
+	dbmap.AddTableWithName(model.Identity{}, model.TableNameIdentity).SetKeys(true, "ID")
+	dbmap.AddTableWithName(model.AuditEvent{}, model.TableNameAuditEvent).SetKeys(true, "ID")
+	dbmap.AddTableWithName(model.CategoryMember{}, model.TableNameCategoryMember)
+	return dbmap, nil
+}
+
+func (d *memDriver) Open(name string) (driver.Conn, error) {
+	return &memConn{d}, nil
+}
+
+type memConn struct {
+	d *memDriver
+}
+
+func (c *memConn) Prepare(query string) (driver.Stmt, error) {
+	return &memStmt{c.d, query}, nil
+}
+
+func (c *memConn) Close() error {
+	return nil
+}
+
+// Begin returns a transaction that can't be rolled back, which is enough
+// for handlers that only roll back after failing.
+func (c *memConn) Begin() (driver.Tx, error) {
+	return c, nil
+}
+
+func (c *memConn) Commit() error {
+	return nil
+}
+
+func (c *memConn) Rollback() error {
+	return nil
+}
+
+type memStmt struct {
+	d     *memDriver
+	query string
+}
+
+func (s *memStmt) Close() error {
+	return nil
+}
+
+func (s *memStmt) NumInput() int {
+	return -1
+}
+
+func (s *memStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+
+	if m := insertRe.FindStringSubmatch(s.query); m != nil {
+		t := s.d.table(m[1])
+		columns := strings.Split(strings.Replace(m[2], "`", "", -1), ",")
+		values := strings.Split(m[3], ",")
+		s.d.lastID++
+		row := map[string]driver.Value{}
+		for i, column := range columns {
+			if strings.TrimSpace(values[i]) == "null" {
+				row[column] = s.d.lastID
+				continue
+			}
+			row[column], args = args[0], args[1:]
+		}
+		t.add(row)
+		return memResult{s.d.lastID}, nil
+	}
+
+	if m := updateRe.FindStringSubmatch(s.query); m != nil {
+		id := args[len(args)-1]
+		for _, row := range s.d.table(m[1]).rows {
+			if !memEqual(row["ID"], id) {
+				continue
+			}
+			for i, set := range strings.Split(m[2], ", ") {
+				row[strings.Trim(strings.TrimSuffix(set, "=?"), "`")] = args[i]
+			}
+		}
+	}
+	return memResult{}, nil
+}
+
+func (s *memStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+
+	m := selectRe.FindStringSubmatch(s.query)
+	if m == nil {
+		return nil, fmt.Errorf("memtest can't run %q", s.query)
+	}
+	t := s.d.table(m[1])
+
+	type condition struct {
+		column string
+		value  driver.Value
+	}
+	conditions := []condition{}
+	for i, c := range conditionRe.FindAllStringSubmatch(m[2], -1) {
+		if c[2] == "=" && i < len(args) {
+			conditions = append(conditions, condition{strings.ToLower(c[1]), args[i]})
+		}
+	}
+
+	rows := &memRows{columns: t.columns}
+	for _, row := range t.rows {
+		match := true
+		for _, c := range conditions {
+			for column, value := range row {
+				if strings.ToLower(column) == c.column && !memEqual(value, c.value) {
+					match = false
+				}
+			}
+		}
+		if match {
+			values := []driver.Value{}
+			for _, column := range t.columns {
+				values = append(values, row[column])
+			}
+			rows.rows = append(rows.rows, values)
+		}
+	}
+	return rows, nil
+}
+
+func (d *memDriver) table(name string) *memTable {
+	t, ok := d.tables[name]
+	if !ok {
+		t = &memTable{columns: []string{"ID"}}
+		d.tables[name] = t
+	}
+	return t
+}
+
+func (t *memTable) add(row map[string]driver.Value) {
+	if len(t.rows) == 0 {
+		t.columns = []string{}
+		for column := range row {
+			t.columns = append(t.columns, column)
+		}
+	}
+	t.rows = append(t.rows, row)
+}
+
+func memEqual(a, b driver.Value) bool {
+	return memString(a) == memString(b)
+}
+
+func memString(v driver.Value) string {
+	switch v := v.(type) {
+	case []byte:
+		return string(v)
+	case bool:
+		if v {
+			return "1"
+		}
+		return "0"
+	}
+	return fmt.Sprint(v)
+}
+
+type memResult struct {
+	id int64
+}
+
+func (r memResult) LastInsertId() (int64, error) {
+	return r.id, nil
+}
+
+func (r memResult) RowsAffected() (int64, error) {
+	return 1, nil
+}
+
+type memRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *memRows) Columns() []string {
+	return r.columns
+}
+
+func (r *memRows) Close() error {
+	return nil
+}
+
+func (r *memRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
@@ -0,0 +1,104 @@
+package mware
+
+import (
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/SyntropyDev/httperr"
+	"github.com/SyntropyDev/mms-api/model"
+	"github.com/dchest/uniuri"
+)
+
+const (
+	requestIDHeader = "X-Request-ID"
+
+	internalMessage = "There was a problem with the system.  If the problem persists contact the administrator."
+	validationCode  = "validation_failed"
+)
+
+// requestIDRe matches the X-Request-ID values accepted from clients, which
+// are written to logs and echoed back.
+var requestIDRe = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// apiError is the json body written for a failed request, and for each
+// failed item of a batch or import.  Fields holds why each rejected field
+// was rejected, keyed by its json name.
+type apiError struct {
+	Status    int               `json:"-"`
+	Code      string            `json:"code"`
+	M         string            `json:"message"`
+	Fields    map[string]string `json:"fields,omitempty"`
+	RequestID string            `json:"requestId,omitempty"`
+}
+
+func (e *apiError) StatusCode() int {
+	return e.Status
+}
+
+func (e *apiError) Message() string {
+	return e.M
+}
+
+func (e *apiError) Error() string {
+	return e.M
+}
+
+// newAPIError converts err, returned while serving r, to the error the
+// client sees.  Internal errors are logged with the request id and
+// replaced by a generic message, so their cause is never exposed.
+func newAPIError(r *http.Request, err error) *apiError {
+	e := &apiError{RequestID: RequestID(r)}
+	switch herr := err.(type) {
+	case *apiError:
+		return herr
+	case *model.FieldsError:
+		e.Status, e.M, e.Fields = herr.Status, herr.M, herr.Fields
+	case httperr.Error:
+		e.Status, e.M = herr.StatusCode(), herr.Message()
+	default:
+		e.Status = http.StatusInternalServerError
+	}
+
+	if e.Status >= http.StatusInternalServerError {
+		log.Printf("request %s: %s %s: %v", e.RequestID, r.Method, r.URL.Path, err)
+		e.M = internalMessage
+	}
+	e.Code = errorCode(e.Status, e.Fields)
+	return e
+}
+
+// errorCode names the kind of error after its status, like not_found.
+func errorCode(status int, fields map[string]string) string {
+	if len(fields) > 0 && status < http.StatusInternalServerError {
+		return validationCode
+	}
+	text := http.StatusText(status)
+	if text == "" {
+		return "error"
+	}
+	text = strings.Replace(text, "-", " ", -1)
+	return strings.ToLower(strings.Replace(text, " ", "_", -1))
+}
+
+// structuredErrors gives each request an id, taken from the X-Request-ID
+// header if the client sent a valid one, and writes h's errors as
+// apiErrors.
+func structuredErrors(h httperr.Handler) httperr.Handler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		id := r.Header.Get(requestIDHeader)
+		if !requestIDRe.MatchString(id) {
+			id = uniuri.NewLen(16)
+		}
+		setRequestID(r, id)
+		defer clearRequestID(r)
+		w.Header().Set(requestIDHeader, id)
+		w.Header().Add("Access-Control-Expose-Headers", requestIDHeader)
+
+		if err := h(w, r); err != nil {
+			return newAPIError(r, err)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,113 @@
+package mware
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/SyntropyDev/httperr"
+	"github.com/SyntropyDev/milli"
+)
+
+const (
+	// requireIfMatchEnv names the config switch that rejects updates sent
+	// without an If-Match header.
+	requireIfMatchEnv = "requireIfMatch"
+)
+
+// etag returns the entity tag for the representation of m sent in reply
+// to r.  It changes whenever m's Updated stamp does, and also with the
+// q-expand and q-fields the client asked for and the relations embedded
+// in m, which change without touching m's own stamp.
+func etag(r *http.Request, m CrudResource) string {
+	h := fnv.New32a()
+	io.WriteString(h, r.URL.Query().Get(KeyExpand)+"\n")
+	io.WriteString(h, r.URL.Query().Get(KeyFields)+"\n")
+	json.NewEncoder(h).Encode(m)
+	return fmt.Sprintf(`"%s-%x"`, version(m), h.Sum32())
+}
+
+// version identifies the stored version of m, regardless of how it's
+// represented.
+func version(m CrudResource) string {
+	return fmt.Sprintf("%d-%d", m.TableId(), updatedStamp(m))
+}
+
+// updatedStamp returns m's Updated millisecond stamp, or 0 if it has none.
+func updatedStamp(m CrudResource) int64 {
+	v := reflect.ValueOf(m).Elem().FieldByName("Updated")
+	if !v.IsValid() || v.Kind() != reflect.Int64 {
+		return 0
+	}
+	return v.Int()
+}
+
+// setValidators sets the ETag and Last-Modified headers for m, which must
+// already have its relations embedded.
+func setValidators(w http.ResponseWriter, r *http.Request, m CrudResource) {
+	w.Header().Set("ETag", etag(r, m))
+	if updated := updatedStamp(m); updated != 0 {
+		w.Header().Set("Last-Modified", milli.Time(updated).UTC().Format(http.TimeFormat))
+	}
+	w.Header().Add("Access-Control-Expose-Headers", "ETag, Last-Modified")
+}
+
+// notModified returns true if the client's cached copy of m, described by
+// the If-None-Match or If-Modified-Since header, is still current.
+// If-None-Match uses the weak comparison.
+func notModified(r *http.Request, m CrudResource) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		tag := etag(r, m)
+		return anyETag(inm, func(t string) bool {
+			return strings.TrimPrefix(t, "W/") == tag
+		})
+	}
+	ims, err := time.Parse(http.TimeFormat, r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	updated := milli.Time(updatedStamp(m))
+	return !updated.Truncate(time.Second).After(ims)
+}
+
+// checkIfMatch returns an error unless the If-Match header names the
+// current version of m.  Without the header the update goes ahead, unless
+// the requireIfMatch switch is on.  If-Match uses the strong comparison,
+// so weak tags never match, but a tag from any representation of the
+// current version does.
+func checkIfMatch(r *http.Request, m CrudResource) error {
+	im := r.Header.Get("If-Match")
+	if im == "" {
+		if os.Getenv(requireIfMatchEnv) == "true" {
+			err := errors.New("If-Match header required")
+			return httperr.New(428, err.Error(), err)
+		}
+		return nil
+	}
+	current := `"` + version(m) + `-`
+	if !anyETag(im, func(t string) bool { return strings.HasPrefix(t, current) }) {
+		message := fmt.Sprintf("%s has changed since it was retrieved.", m.TableName())
+		err := errors.New(message)
+		return httperr.New(http.StatusPreconditionFailed, message, err)
+	}
+	return nil
+}
+
+// anyETag returns true if header, a list of entity tags or "*", is "*" or
+// includes a tag that match accepts.
+func anyETag(header string, match func(tag string) bool) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || match(t) {
+			return true
+		}
+	}
+	return false
+}
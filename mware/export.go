@@ -0,0 +1,317 @@
+package mware
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/SyntropyDev/httperr"
+	"github.com/SyntropyDev/mms-api/model"
+	"github.com/coopernurse/gorp"
+)
+
+const (
+	KeyFormat = "q-format"
+
+	formatJSON   = "json"
+	formatCSV    = "csv"
+	formatNDJSON = "ndjson"
+
+	jsonType   = "application/json"
+	csvType    = "text/csv"
+	ndjsonType = "application/x-ndjson"
+
+	// exportChunk is how many rows are selected at a time while exporting.
+	exportChunk = 500
+)
+
+// listFormat returns the format a list is written in, chosen with q-format
+// or else the media type the Accept header prefers.
+func listFormat(r *http.Request) (string, error) {
+	switch f := r.URL.Query().Get(KeyFormat); f {
+	case formatJSON, formatCSV, formatNDJSON:
+		return f, nil
+	case "":
+	default:
+		err := fmt.Errorf("q-format, %v, is invalid.  Must use json, csv or ndjson.", f)
+		return "", httperr.New(http.StatusBadRequest, err.Error(), err)
+	}
+
+	accept := r.Header.Get("Accept")
+	best, bestQ := formatJSON, 0.0
+	for _, f := range []struct{ format, mediaType string }{
+		{formatJSON, jsonType},
+		{formatCSV, csvType},
+		{formatNDJSON, ndjsonType},
+	} {
+		if q := acceptQ(accept, f.mediaType); q > bestQ {
+			best, bestQ = f.format, q
+		}
+	}
+	return best, nil
+}
+
+// acceptQ returns the q-value accept gives mediaType, taken from the most
+// specific media range matching it, or 0 if none does.
+func acceptQ(accept, mediaType string) float64 {
+	q, specificity := 0.0, -1
+	for _, mediaRange := range strings.Split(accept, ",") {
+		params := strings.Split(mediaRange, ";")
+		rangeType := strings.ToLower(strings.TrimSpace(params[0]))
+		s := 0
+		switch {
+		case rangeType == mediaType:
+			s = 2
+		case strings.HasSuffix(rangeType, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(rangeType, "*")):
+			s = 1
+		case rangeType == "*/*":
+		default:
+			continue
+		}
+		if s <= specificity {
+			continue
+		}
+		specificity, q = s, 1
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				if v, err := strconv.ParseFloat(p[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+	}
+	return q
+}
+
+// exportWriter writes exported rows in one format.
+type exportWriter interface {
+	write(m interface{}) error
+	flush() error
+}
+
+// export writes every row matching q, or the first q-limit rows if one is
+// given.  Unauthenticated requests get no more than defaultLimit rows.
+// Rows are selected a chunk at a time, continuing from a keyset cursor, and
+// flushed to the client after each chunk so a large export never sits in
+// memory at once.
+func export(w http.ResponseWriter, r *http.Request, s gorp.SqlExecutor, m CrudResource, q *listQuery, format string) error {
+	values := r.URL.Query()
+	limited, remaining := values.Get(KeyLimit) != "", q.limit
+	if !exportAuthenticated(s, w, r) && (!limited || remaining > defaultLimit) {
+		limited, remaining = true, defaultLimit
+	}
+
+	var ew exportWriter
+	switch format {
+	case formatCSV:
+		w.Header().Set("Content-Type", csvType)
+		ew = newCSVExport(w, m, values)
+	default:
+		w.Header().Set("Content-Type", ndjsonType)
+		ew = &ndjsonExport{enc: json.NewEncoder(w), values: values}
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, m.TableName(), format))
+
+	for {
+		q.limit = exportChunk
+		if limited && remaining < exportChunk {
+			q.limit = remaining
+		}
+		sql, args, err := q.ToSql()
+		if err != nil {
+			return err
+		}
+		models, err := s.Select(m, sql, args...)
+		if err != nil {
+			return err
+		}
+		models, next := q.next(models)
+		if err := model.Expand(s, models, expandRelations(values)); err != nil {
+			return err
+		}
+		for _, row := range models {
+			if err := ew.write(row); err != nil {
+				return err
+			}
+		}
+		if err := ew.flush(); err != nil {
+			return err
+		}
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+
+		remaining -= uint64(len(models))
+		if next == nil || (limited && remaining == 0) {
+			return nil
+		}
+		q.cursor = next
+	}
+}
+
+// exportAuthenticated returns true if r was sent with an api key or a
+// member's token.
+func exportAuthenticated(s gorp.SqlExecutor, w http.ResponseWriter, r *http.Request) bool {
+	if CurrentAPIKey(r) != nil || CurrentMember(r) != nil {
+		return true
+	}
+	if r.Header.Get(authHeader) == "" {
+		return false
+	}
+	_, _, err := authenticate(s, w, r)
+	return err == nil
+}
+
+type ndjsonExport struct {
+	enc    *json.Encoder
+	values url.Values
+}
+
+func (e *ndjsonExport) write(m interface{}) error {
+	if e.values.Get(KeyFields) == "" {
+		return e.enc.Encode(m)
+	}
+	slim := selectFields(e.values, []interface{}{m}).([]map[string]interface{})
+	return e.enc.Encode(slim[0])
+}
+
+func (e *ndjsonExport) flush() error { return nil }
+
+// csvExport writes a header row of json keys, then a row per model.  List
+// values are joined with semicolons.
+type csvExport struct {
+	w       *csv.Writer
+	columns []exportColumn
+	header  bool
+}
+
+type exportColumn struct {
+	field string
+	key   string
+}
+
+func newCSVExport(w http.ResponseWriter, m CrudResource, values url.Values) *csvExport {
+	return &csvExport{
+		w:       csv.NewWriter(w),
+		columns: exportColumns(m, values),
+	}
+}
+
+func (e *csvExport) write(m interface{}) error {
+	if err := e.writeHeader(); err != nil {
+		return err
+	}
+	mV := reflect.ValueOf(m).Elem()
+	record := []string{}
+	for _, c := range e.columns {
+		record = append(record, csvValue(mV.FieldByName(c.field)))
+	}
+	return e.w.Write(record)
+}
+
+// writeHeader writes the header row if it hasn't been yet, so even an
+// empty export has one.
+func (e *csvExport) writeHeader() error {
+	if e.header {
+		return nil
+	}
+	e.header = true
+	header := []string{}
+	for _, c := range e.columns {
+		header = append(header, c.key)
+	}
+	return e.w.Write(header)
+}
+
+func (e *csvExport) flush() error {
+	if err := e.writeHeader(); err != nil {
+		return err
+	}
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// exportColumns returns the columns listed in q-fields, or otherwise every
+// field always present in m's json.  Embedded resources and fields left
+// out when empty aren't exported.
+func exportColumns(m CrudResource, values url.Values) []exportColumn {
+	objT := reflect.TypeOf(m).Elem()
+	byKey := map[string]string{}
+	columns := []exportColumn{}
+	for i := 0; i < objT.NumField(); i++ {
+		field := objT.Field(i)
+		tag := field.Tag.Get("json")
+		key := getJsonKeyFromTag(tag)
+		if key == "-" {
+			continue
+		}
+		byKey[key] = field.Name
+		switch field.Type.Kind() {
+		case reflect.Ptr, reflect.Struct, reflect.Map:
+			continue
+		}
+		if strings.Contains(tag, "omitempty") {
+			continue
+		}
+		columns = append(columns, exportColumn{field: field.Name, key: key})
+	}
+
+	if values.Get(KeyFields) == "" {
+		return columns
+	}
+	columns = []exportColumn{{field: "ID", key: "id"}}
+	for _, key := range strings.Split(values.Get(KeyFields), ",") {
+		if field, ok := byKey[key]; ok && key != "id" {
+			columns = append(columns, exportColumn{field: field, key: key})
+		}
+	}
+	return columns
+}
+
+// csvValue returns v as a cell.  Text a spreadsheet would run as a formula
+// is prefixed with a quote so it's shown as is.
+func csvValue(v reflect.Value) string {
+	value, numeric := "", isNumeric(v.Type())
+	switch v.Kind() {
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			// raw json, like an audit event's before and after
+			value = string(v.Bytes())
+			break
+		}
+		items := []string{}
+		for i := 0; i < v.Len(); i++ {
+			items = append(items, fmt.Sprint(v.Index(i).Interface()))
+		}
+		value, numeric = strings.Join(items, ";"), isNumeric(v.Type().Elem())
+	case reflect.Ptr, reflect.Struct, reflect.Map:
+		b, err := json.Marshal(v.Interface())
+		if err != nil {
+			return ""
+		}
+		value = string(b)
+	default:
+		value = fmt.Sprint(v.Interface())
+	}
+
+	if !numeric && value != "" && strings.ContainsAny(value[:1], "=+-@\t\r") {
+		return "'" + value
+	}
+	return value
+}
+
+func isNumeric(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
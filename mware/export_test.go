@@ -0,0 +1,61 @@
+package mware
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/SyntropyDev/mms-api/model"
+)
+
+func TestCSVExportAuditEvent(t *testing.T) {
+	w := httptest.NewRecorder()
+	e := newCSVExport(w, &model.AuditEvent{}, url.Values{})
+	event := &model.AuditEvent{
+		ID:            1,
+		ActorType:     model.ActorTypeMember,
+		ActorID:       2,
+		Action:        model.AuditActionUpdate,
+		ResourceTable: model.TableNameMember,
+		ResourceID:    3,
+		Before:        json.RawMessage(`{"name":"old"}`),
+		After:         json.RawMessage(`{"name":"new"}`),
+	}
+	if err := e.write(event); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("got %d records, want a header and a row", len(records))
+	}
+	row := map[string]string{}
+	for i, key := range records[0] {
+		row[key] = records[1][i]
+	}
+	if row["before"] != `{"name":"old"}` || row["after"] != `{"name":"new"}` {
+		t.Errorf("before and after exported as %q and %q", row["before"], row["after"])
+	}
+}
+
+func TestCSVValueQuotesFormulas(t *testing.T) {
+	for value, want := range map[interface{}]string{
+		"=1+1": "'=1+1",
+		"-5":   "'-5",
+		-5:     "-5",
+		"name": "name",
+	} {
+		if got := csvValue(reflect.ValueOf(value)); got != want {
+			t.Errorf("csvValue(%#v) = %q, want %q", value, got, want)
+		}
+	}
+}
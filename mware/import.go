@@ -0,0 +1,432 @@
+package mware
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SyntropyDev/httperr"
+	"github.com/SyntropyDev/milli"
+	"github.com/SyntropyDev/mms-api/model"
+	"github.com/SyntropyDev/sqlutil"
+	"github.com/coopernurse/gorp"
+	"github.com/lann/squirrel"
+)
+
+const (
+	KeyDryRun = "dryRun"
+
+	importCategoriesColumn = "categories"
+
+	// importMaxRowsEnv names the config value limiting the rows in one
+	// import.
+	importMaxRowsEnv     = "importMaxRows"
+	defaultImportMaxRows = 5000
+)
+
+// importColumns maps the columns of an import to what they set.
+type importColumns struct {
+	fields     map[int]string
+	feeds      map[int]model.FeedType
+	categories int
+}
+
+// importRow is a member read from one record of an import, along with its
+// feeds and why any of its fields were rejected.
+type importRow struct {
+	line   int
+	member *model.Member
+	feeds  []*model.Feed
+	fields map[string]string
+}
+
+// importResp holds the members created, or with errors, the failure for
+// each bad row keyed by its line number.
+type importResp struct {
+	DryRun  bool                 `json:"dryRun"`
+	Members []*model.Member      `json:"members,omitempty"`
+	Errors  map[string]*apiError `json:"errors,omitempty"`
+}
+
+// ImportMembersHandler creates members from a csv body.  The header row
+// names each column: a member field by field or json name, categories
+// holding category names separated by semicolons, or twitter, facebook or
+// rss holding the identifier of a feed to create.  Every row is validated
+// first, including that its email and feeds aren't taken, and nothing is
+// written if any row fails or dryRun=true is passed.
+func ImportMembersHandler() httperr.Handler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		dryRun := r.URL.Query().Get(KeyDryRun) == "true"
+
+		dbmap, err := getDB()
+		defer dbmap.Db.Close()
+		if err != nil {
+			return err
+		}
+
+		trans, err := dbmap.Begin()
+		if err != nil {
+			return err
+		}
+
+		rows, resp, err := readImport(trans, r)
+		if err != nil {
+			trans.Rollback()
+			return err
+		}
+		resp.DryRun = dryRun
+
+		if len(resp.Errors) > 0 || dryRun {
+			trans.Rollback()
+			if len(resp.Errors) > 0 {
+				w.WriteHeader(http.StatusBadRequest)
+			}
+			return json.NewEncoder(w).Encode(resp)
+		}
+
+		// keep going after a failure so every bad row is reported at once
+		status := http.StatusBadRequest
+		for _, row := range rows {
+			if err := createImportRow(trans, r, row); err != nil {
+				_, e := newBatchError(r, err)
+				resp.Errors[strconv.Itoa(row.line)] = e
+				if e.Status >= http.StatusInternalServerError {
+					status = e.Status
+				}
+				continue
+			}
+			resp.Members = append(resp.Members, row.member)
+		}
+
+		if len(resp.Errors) > 0 {
+			trans.Rollback()
+			resp.Members = nil
+			w.WriteHeader(status)
+			return json.NewEncoder(w).Encode(resp)
+		}
+		if err := trans.Commit(); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusCreated)
+		return json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// readImport parses and validates every row of the csv in r's body.
+func readImport(s gorp.SqlExecutor, r *http.Request) ([]*importRow, *importResp, error) {
+	lines := &lineCounter{r: bufio.NewReader(r.Body)}
+	reader := csv.NewReader(lines)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, nil, clientError(err)
+	}
+	columns, err := parseImportHeader(header)
+	if err != nil {
+		return nil, nil, err
+	}
+	categories, err := categoryIDsByName(s)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	max := model.ConfigInt(importMaxRowsEnv, defaultImportMaxRows)
+	rows := []*importRow{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, clientError(err)
+		}
+		if len(rows) == max {
+			err := fmt.Errorf("import has more than %d rows", max)
+			return nil, nil, httperr.New(http.StatusRequestEntityTooLarge, err.Error(), err)
+		}
+
+		row := columns.row(record, categories)
+		row.line = lines.recordLine(record)
+		rows = append(rows, row)
+	}
+
+	if err := checkImportDuplicates(s, rows); err != nil {
+		return nil, nil, err
+	}
+	resp := &importResp{Errors: map[string]*apiError{}}
+	for _, row := range rows {
+		if len(row.fields) > 0 {
+			err := model.NewFieldsError(http.StatusBadRequest, "row did not pass validation.", row.fields)
+			resp.Errors[strconv.Itoa(row.line)] = newAPIError(r, err)
+		}
+	}
+	return rows, resp, nil
+}
+
+// lineCounter hands the csv reader one line per read, so after each record
+// it knows the line the record ended on.
+type lineCounter struct {
+	r       *bufio.Reader
+	pending []byte
+	err     error
+	lines   int
+	last    byte
+}
+
+func (lc *lineCounter) Read(p []byte) (int, error) {
+	if len(lc.pending) == 0 {
+		if lc.err != nil {
+			return 0, lc.err
+		}
+		lc.pending, lc.err = lc.r.ReadBytes('\n')
+		if len(lc.pending) == 0 {
+			return 0, lc.err
+		}
+	}
+	n := copy(p, lc.pending)
+	lc.pending = lc.pending[n:]
+	lc.lines += bytes.Count(p[:n], []byte{'\n'})
+	lc.last = p[n-1]
+	return n, nil
+}
+
+// recordLine returns the line record, just read, started on.  Quoted cells
+// may hold line breaks, so a record can span several lines.
+func (lc *lineCounter) recordLine(record []string) int {
+	line := lc.lines
+	if lc.last != '\n' {
+		line++
+	}
+	for _, value := range record {
+		line -= strings.Count(value, "\n")
+	}
+	return line
+}
+
+func parseImportHeader(header []string) (*importColumns, error) {
+	columns := &importColumns{
+		fields:     map[int]string{},
+		feeds:      map[int]model.FeedType{},
+		categories: -1,
+	}
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == importCategoriesColumn {
+			columns.categories = i
+			continue
+		}
+		isFeed := false
+		for _, ft := range model.FeedTypes() {
+			if name == string(ft) {
+				columns.feeds[i] = ft
+				isFeed = true
+			}
+		}
+		if isFeed {
+			continue
+		}
+		field, ok := importField(name)
+		if !ok {
+			err := fmt.Errorf("column, %v, can't be imported.", name)
+			return nil, httperr.New(http.StatusBadRequest, err.Error(), err)
+		}
+		columns.fields[i] = field
+	}
+	return columns, nil
+}
+
+// importField returns the mergeable text or number field of Member named
+// name by field or json name.
+func importField(name string) (string, bool) {
+	objT := reflect.TypeOf(model.Member{})
+	for i := 0; i < objT.NumField(); i++ {
+		field := objT.Field(i)
+		if field.Tag.Get("merge") != "true" {
+			continue
+		}
+		if field.Type.Kind() != reflect.String && field.Type.Kind() != reflect.Float64 {
+			continue
+		}
+		jsonKey := strings.ToLower(getJsonKeyFromTag(field.Tag.Get("json")))
+		if strings.ToLower(field.Name) == name || jsonKey == name {
+			return field.Name, true
+		}
+	}
+	return "", false
+}
+
+// row builds the member and feeds in record and validates them.  The
+// failures are keyed by json name, or for feeds by column.
+func (c *importColumns) row(record []string, categories map[string]int64) *importRow {
+	fields := map[string]string{}
+	row := &importRow{member: &model.Member{}, fields: fields}
+
+	mV := reflect.ValueOf(row.member).Elem()
+	for i, name := range c.fields {
+		value := strings.TrimSpace(record[i])
+		fV := mV.FieldByName(name)
+		if fV.Kind() == reflect.Float64 {
+			if value == "" {
+				continue
+			}
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				fields[importFieldKey(name)] = "must be a number"
+				continue
+			}
+			fV.SetFloat(f)
+			continue
+		}
+		fV.SetString(value)
+	}
+
+	if c.categories >= 0 {
+		for _, name := range strings.Split(record[c.categories], ";") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			id, ok := categories[strings.ToLower(name)]
+			if !ok {
+				fields[importCategoriesColumn] = fmt.Sprintf("unknown category %s", name)
+				continue
+			}
+			row.member.CategoryIds = append(row.member.CategoryIds, id)
+		}
+	}
+
+	// the timestamps are set on insert, so stand in for them here
+	now := milli.Timestamp(time.Now())
+	row.member.Created, row.member.Updated = now, now
+	for key, err := range model.ValidationFields(row.member) {
+		fields[key] = err
+	}
+
+	for i, ft := range c.feeds {
+		identifier := strings.TrimSpace(record[i])
+		if identifier == "" {
+			continue
+		}
+		feed := &model.Feed{
+			Type:       string(ft),
+			Identifier: identifier,
+			// the member's id isn't known until it's inserted
+			MemberID: 1,
+			Created:  now,
+			Updated:  now,
+		}
+		for _, err := range model.ValidationFields(feed) {
+			fields[string(ft)] = err
+		}
+		feed.MemberID = 0
+		row.feeds = append(row.feeds, feed)
+	}
+	return row
+}
+
+// importFieldKey returns the key a failure of Member's field name is
+// reported under, its json name or if it has none its field name, which
+// matches model.ValidationFields.
+func importFieldKey(name string) string {
+	field, _ := reflect.TypeOf(model.Member{}).FieldByName(name)
+	if key := getJsonKeyFromTag(field.Tag.Get("json")); key != "-" && key != "" {
+		return key
+	}
+	return name
+}
+
+// checkImportDuplicates rejects the rows whose email or feeds are already
+// taken, either by a saved member or feed or by an earlier row.
+func checkImportDuplicates(s gorp.SqlExecutor, rows []*importRow) error {
+	emails := []string{}
+	identifiers := map[string][]string{}
+	for _, row := range rows {
+		if row.member.Email != "" {
+			emails = append(emails, row.member.Email)
+		}
+		for _, feed := range row.feeds {
+			identifiers[feed.Type] = append(identifiers[feed.Type], feed.Identifier)
+		}
+	}
+
+	// mysql compares them without case, so do the same here
+	takenEmails := map[string]bool{}
+	if len(emails) > 0 {
+		members := []*model.Member{}
+		query := squirrel.Select("*").From(model.TableNameMember).
+			Where(squirrel.Eq{"Email": emails})
+		if err := sqlutil.Select(s, query, &members); err != nil {
+			return err
+		}
+		for _, m := range members {
+			takenEmails[strings.ToLower(m.Email)] = true
+		}
+	}
+	takenFeeds := map[string]bool{}
+	for ft, ids := range identifiers {
+		feeds := []*model.Feed{}
+		query := squirrel.Select("*").From(model.TableNameFeed).
+			Where(squirrel.Eq{"Type": ft, "Identifier": ids})
+		if err := sqlutil.Select(s, query, &feeds); err != nil {
+			return err
+		}
+		for _, feed := range feeds {
+			takenFeeds[ft+" "+strings.ToLower(feed.Identifier)] = true
+		}
+	}
+
+	for _, row := range rows {
+		if email := strings.ToLower(row.member.Email); email != "" {
+			if takenEmails[email] {
+				row.fields[importFieldKey("Email")] = "is already taken"
+			}
+			takenEmails[email] = true
+		}
+		for _, feed := range row.feeds {
+			key := feed.Type + " " + strings.ToLower(feed.Identifier)
+			if takenFeeds[key] {
+				row.fields[feed.Type] = "is already taken"
+			}
+			takenFeeds[key] = true
+		}
+	}
+	return nil
+}
+
+// categoryIDsByName returns the ids of the categories that aren't deleted
+// keyed by their lower case name.
+func categoryIDsByName(s gorp.SqlExecutor) (map[string]int64, error) {
+	categories := []*model.Category{}
+	query := "select * from " + model.TableNameCategory + " where Deleted = ?"
+	if _, err := s.Select(&categories, query, false); err != nil {
+		return nil, err
+	}
+	ids := map[string]int64{}
+	for _, c := range categories {
+		ids[strings.ToLower(c.Name)] = c.ID
+	}
+	return ids, nil
+}
+
+func createImportRow(s gorp.SqlExecutor, r *http.Request, row *importRow) error {
+	if err := createResource(s, r, row.member); err != nil {
+		return err
+	}
+	for _, feed := range row.feeds {
+		feed.MemberID = row.member.ID
+		if err := createResource(s, r, feed); err != nil {
+			return err
+		}
+		row.member.Feeds = append(row.member.Feeds, feed)
+	}
+	return nil
+}
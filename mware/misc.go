@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"strconv"
 
 	"github.com/SyntropyDev/httperr"
 	"github.com/SyntropyDev/mms-api/model"
@@ -35,24 +34,39 @@ func TopStoriesHandler() httperr.Handler {
 			}
 		}
 
-		limit, err := strconv.ParseUint(v.Get("q-limit"), 10, 64)
+		q := &listQuery{table: model.TableNameStory, resource: &model.Story{}}
+		q.orderBy("Score", true)
+		q.orderBy("ID", true)
+		if len(memIDs) > 0 {
+			q.where(squirrel.Eq{"memberId": memIDs})
+		}
+		include, err := includeDeleted(dbmap, w, r)
 		if err != nil {
-			limit = 20
+			return err
 		}
-
-		offset, _ := strconv.ParseUint(v.Get("q-offset"), 10, 64)
-
-		query := squirrel.Select("*").From(model.TableNameStory).OrderBy("Score desc").Limit(limit).Offset(offset)
-		if len(memIDs) > 0 {
-			query = query.Where(squirrel.Eq{"memberId": memIDs})
+		if !include {
+			// stories of deleted members and feeds aren't ranked either
+			q.where("Deleted = ?", false)
+			q.where("MemberID in (select ID from "+model.TableNameMember+" where Deleted = ?)", false)
+			q.where("FeedID in (select ID from "+model.TableNameFeed+" where Deleted = ?)", false)
+		}
+		if err := q.parsePage(v, 20); err != nil {
+			return err
 		}
 
-		stories := []*model.Story{}
-		if err := sqlutil.Select(dbmap, query, &stories); err != nil {
+		sql, args, err := q.ToSql()
+		if err != nil {
+			return err
+		}
+		stories, err := dbmap.Select(&model.Story{}, sql, args...)
+		if err != nil {
+			return err
+		}
+		if err := model.Expand(dbmap, stories, expandRelations(v)); err != nil {
 			return err
 		}
 
-		return json.NewEncoder(w).Encode(stories)
+		return writeList(w, r, dbmap, q, stories)
 	}
 }
 
@@ -73,6 +87,17 @@ func CommunityHandler() httperr.Handler {
 	}
 }
 
+// PreflightHandler answers CORS preflight requests.  Unlike the defaults set
+// by httperr it allows the Authorization and X-API-Key headers, and the
+// conditional request headers.
+func PreflightHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET,PUT,PATCH,POST,DELETE,HEAD,OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type,x-requested-with,Authorization,X-API-Key,If-Match,If-None-Match,If-Modified-Since,X-Request-ID")
+	})
+}
+
 func ConstantHandler(src interface{}) httperr.Handler {
 	return func(w http.ResponseWriter, r *http.Request) error {
 		return json.NewEncoder(w).Encode(src)
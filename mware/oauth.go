@@ -0,0 +1,245 @@
+package mware
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SyntropyDev/httperr"
+	"github.com/SyntropyDev/mms-api/model"
+	"github.com/dchest/uniuri"
+	"github.com/garyburd/go-oauth/oauth"
+)
+
+const (
+	// oauthCallbackEnv names the config value with the public URL of the
+	// oauth routes, e.g. https://api.example.com/api/v1/oauth
+	oauthCallbackEnv = "oauthCallbackUrl"
+
+	oauthStateTTL = 10 * time.Minute
+
+	// oauthCookie names the cookie binding an exchange to the browser that
+	// started it, so a callback can't be replayed in someone else's.
+	oauthCookie = "oauth_nonce"
+)
+
+// oauthState remembers an exchange between its start and its callback.
+type oauthState struct {
+	provider   model.FeedType
+	memberID   int64
+	createFeed bool
+	nonce      string
+	temp       *oauth.Credentials
+	expires    time.Time
+}
+
+var (
+	oauthStatesMu sync.Mutex
+	oauthStates   = map[string]*oauthState{}
+)
+
+// OAuthStartHandler starts logging in with, or linking, a Twitter or
+// Facebook account and responds with the provider URL to send the member to.
+// Requests with credentials link the account to the authenticated member,
+// creating the matching feed when createFeed is true.  The exchange can only
+// be finished by the browser given its cookie.
+func OAuthStartHandler() httperr.Handler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		dbmap, err := getDB()
+		defer dbmap.Db.Close()
+		if err != nil {
+			return err
+		}
+
+		v := r.URL.Query()
+		provider := model.FeedType(v.Get(":provider"))
+		state := &oauthState{
+			provider:   provider,
+			createFeed: v.Get("createFeed") == "true",
+			nonce:      uniuri.NewLen(32),
+			expires:    time.Now().Add(oauthStateTTL),
+		}
+		if r.Header.Get(authHeader) != "" || v.Get(authTokenKey) != "" {
+			member, _, err := authenticate(dbmap, w, r)
+			if err != nil {
+				return err
+			}
+			state.memberID = member.ID
+		}
+
+		key, authURL := "", ""
+		callback := oauthCallbackURL(provider)
+		switch provider {
+		case model.FeedTypeTwitter:
+			u, temp, err := model.TwitterAuthorization(callback)
+			if err != nil {
+				return errOAuth(err)
+			}
+			key, authURL, state.temp = temp.Token, u, temp
+		case model.FeedTypeFacebook:
+			key = uniuri.NewLen(32)
+			authURL = model.FacebookAuthorization(callback, key)
+		default:
+			return errUnknownProvider()
+		}
+		putOAuthState(key, state)
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     oauthCookie,
+			Value:    state.nonce,
+			Path:     oauthCookiePath(r),
+			MaxAge:   int(oauthStateTTL / time.Second),
+			Secure:   strings.HasPrefix(os.Getenv(oauthCallbackEnv), "https"),
+			HttpOnly: true,
+		})
+		return json.NewEncoder(w).Encode(map[string]string{"url": authURL})
+	}
+}
+
+// OAuthCallbackHandler finishes an exchange started by OAuthStartHandler.
+// It responds like LoginHandler when logging in, including any two factor
+// challenge, and with the new identity when linking.
+func OAuthCallbackHandler() httperr.Handler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		v := r.URL.Query()
+		provider := model.FeedType(v.Get(":provider"))
+
+		var account *model.ExternalAccount
+		switch provider {
+		case model.FeedTypeTwitter:
+			state, err := takeOAuthState(w, r, provider, v.Get("oauth_token"))
+			if err != nil {
+				return err
+			}
+			if account, err = model.TwitterAccount(state.temp, v.Get("oauth_verifier")); err != nil {
+				return errOAuth(err)
+			}
+			return finishOAuth(w, r, state, account)
+		case model.FeedTypeFacebook:
+			state, err := takeOAuthState(w, r, provider, v.Get("state"))
+			if err != nil {
+				return err
+			}
+			if account, err = model.FacebookAccount(oauthCallbackURL(provider), v.Get("code")); err != nil {
+				return errOAuth(err)
+			}
+			return finishOAuth(w, r, state, account)
+		}
+		return errUnknownProvider()
+	}
+}
+
+func finishOAuth(w http.ResponseWriter, r *http.Request, state *oauthState, account *model.ExternalAccount) error {
+	dbmap, err := getDB()
+	defer dbmap.Db.Close()
+	if err != nil {
+		return err
+	}
+
+	if state.memberID == 0 {
+		member, err := model.FindIdentityMember(dbmap, account)
+		if err != nil {
+			return err
+		}
+		return startSession(w, r, dbmap, member)
+	}
+
+	trans, err := dbmap.Begin()
+	if err != nil {
+		return err
+	}
+	member := &model.Member{}
+	if err := GetID(trans, member, state.memberID); err != nil {
+		trans.Rollback()
+		return err
+	}
+	// the callback acts for the member who started the exchange
+	setContext(r, &requestContext{member: member})
+	defer clearContext(r)
+
+	identity, feed, err := model.LinkIdentity(trans, member, account, state.createFeed)
+	if err != nil {
+		trans.Rollback()
+		return err
+	}
+	if err := audit(trans, r, model.AuditActionLink, identity, nil, identity); err != nil {
+		trans.Rollback()
+		return err
+	}
+	if feed != nil {
+		if err := audit(trans, r, model.AuditActionCreate, feed, nil, feed); err != nil {
+			trans.Rollback()
+			return err
+		}
+	}
+	if err := trans.Commit(); err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(identity)
+}
+
+func oauthCallbackURL(provider model.FeedType) string {
+	base := strings.TrimRight(os.Getenv(oauthCallbackEnv), "/")
+	return base + "/" + string(provider) + "/callback"
+}
+
+func putOAuthState(key string, state *oauthState) {
+	oauthStatesMu.Lock()
+	defer oauthStatesMu.Unlock()
+
+	now := time.Now()
+	for k, s := range oauthStates {
+		if now.After(s.expires) {
+			delete(oauthStates, k)
+		}
+	}
+	oauthStates[key] = state
+}
+
+// oauthCookiePath scopes the cookie to the provider's oauth routes, the
+// start and callback routes both being under it.
+func oauthCookiePath(r *http.Request) string {
+	return path.Dir(r.URL.Path)
+}
+
+// takeOAuthState returns and forgets the state stored under key so every
+// exchange can only be finished once, and only by the browser holding the
+// exchange's cookie.
+func takeOAuthState(w http.ResponseWriter, r *http.Request, provider model.FeedType, key string) (*oauthState, error) {
+	oauthStatesMu.Lock()
+	defer oauthStatesMu.Unlock()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:   oauthCookie,
+		Path:   oauthCookiePath(r),
+		MaxAge: -1,
+	})
+
+	state, ok := oauthStates[key]
+	delete(oauthStates, key)
+	if !ok || state.provider != provider || time.Now().After(state.expires) {
+		err := errors.New("oauth exchange expired, please try again")
+		return nil, httperr.New(http.StatusBadRequest, err.Error(), err)
+	}
+	cookie, err := r.Cookie(oauthCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state.nonce)) != 1 {
+		err := errors.New("oauth exchange was started in another browser")
+		return nil, httperr.New(http.StatusForbidden, err.Error(), err)
+	}
+	return state, nil
+}
+
+func errOAuth(err error) error {
+	return httperr.New(http.StatusBadGateway, "could not complete the exchange with the provider", err)
+}
+
+func errUnknownProvider() error {
+	err := errors.New("unknown oauth provider")
+	return httperr.New(http.StatusNotFound, err.Error(), err)
+}
@@ -0,0 +1,216 @@
+package mware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/SyntropyDev/mms-api/model"
+)
+
+// fakeFacebook stands in for Facebook's token, graph and dialog endpoints.
+// Every code trades for the same account, 42.
+func fakeFacebook() *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth/access_token", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"access_token":"fake"}`))
+	})
+	mux.HandleFunc("/me", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id":"42","name":"Someone"}`))
+	})
+	// looked up by the facebook feed on insert
+	mux.HandleFunc("/42", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id":"42","cover":{"source":"http://example.com/cover.png"}}`))
+	})
+	return httptest.NewServer(mux)
+}
+
+// graphTransport sends requests for graph.facebook.com, which the facebook
+// library doesn't let us configure, to the fake.
+type graphTransport struct {
+	fake *url.URL
+}
+
+func (t *graphTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.URL.Host == "graph.facebook.com" {
+		r.URL.Scheme, r.URL.Host = t.fake.Scheme, t.fake.Host
+	}
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+// setupOAuth points the oauth routes at a fake Facebook and the handlers at
+// the in memory database, and returns a member with a bearer token.
+func setupOAuth(t *testing.T) (*model.Member, string, func()) {
+	fake := fakeFacebook()
+	u, _ := url.Parse(fake.URL)
+	env := map[string]string{
+		"tokenSecret":       "secret",
+		"facebookTokenUrl":  fake.URL + "/oauth/access_token",
+		"facebookGraphUrl":  fake.URL,
+		"facebookDialogUrl": fake.URL + "/dialog/oauth",
+		oauthCallbackEnv:    "http://api.example.com" + testPrefix + "/oauth",
+	}
+	for k, v := range env {
+		os.Setenv(k, v)
+	}
+	http.DefaultClient.Transport = &graphTransport{u}
+	memDB.reset()
+	db := getDB
+	SetGetDBConnectionFunc(memDbMap)
+
+	dbmap, err := memDbMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	member := &model.Member{Name: "Someone"}
+	if err := dbmap.Insert(member); err != nil {
+		t.Fatal(err)
+	}
+	token := &model.Token{MemberID: member.ID}
+	if err := dbmap.Insert(token); err != nil {
+		t.Fatal(err)
+	}
+
+	return member, token.Value, func() {
+		fake.Close()
+		SetGetDBConnectionFunc(db)
+		http.DefaultClient.Transport = nil
+		for k := range env {
+			os.Setenv(k, "")
+		}
+	}
+}
+
+// startOAuth starts a facebook exchange and returns the state the provider
+// would send back and the cookie binding it to the browser.
+func startOAuth(t *testing.T, rt http.Handler, bearer string, createFeed bool) (string, *http.Cookie) {
+	u := testPrefix + "/oauth/facebook/start"
+	if createFeed {
+		u += "?createFeed=true"
+	}
+	r, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set(authHeader, authBearerPrefix+bearer)
+	w := httptest.NewRecorder()
+	rt.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("start got %d, %s", w.Code, w.Body.String())
+	}
+
+	resp := map[string]string{}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	authURL, err := url.Parse(resp["url"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookie := (&http.Response{Header: w.HeaderMap}).Cookies()
+	if len(cookie) != 1 || cookie[0].Name != oauthCookie {
+		t.Fatalf("start set cookies %v, want %s", cookie, oauthCookie)
+	}
+	return authURL.Query().Get("state"), cookie[0]
+}
+
+// callbackOAuth returns what the callback answers to the provider's
+// redirect with state, from the browser holding cookie.
+func callbackOAuth(t *testing.T, rt http.Handler, state string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	v := url.Values{}
+	v.Set("state", state)
+	v.Set("code", "code")
+	r, err := http.NewRequest("GET", testPrefix+"/oauth/facebook/callback?"+v.Encode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cookie != nil {
+		r.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+	}
+	w := httptest.NewRecorder()
+	rt.ServeHTTP(w, r)
+	return w
+}
+
+func auditActions() []string {
+	actions := []string{}
+	for _, row := range memDB.rows(model.TableNameAuditEvent) {
+		actions = append(actions, memString(row["Action"]))
+	}
+	return actions
+}
+
+func TestOAuthLinksIdentityAndFeed(t *testing.T) {
+	member, bearer, teardown := setupOAuth(t)
+	defer teardown()
+	rt := APIRouter(testPrefix)
+
+	state, cookie := startOAuth(t, rt, bearer, true)
+	w := callbackOAuth(t, rt, state, cookie)
+	if w.Code != http.StatusOK {
+		t.Fatalf("callback got %d, %s", w.Code, w.Body.String())
+	}
+	identity := &model.Identity{}
+	if err := json.NewDecoder(w.Body).Decode(identity); err != nil {
+		t.Fatal(err)
+	}
+	if identity.MemberID != member.ID || identity.Provider != string(model.FeedTypeFacebook) || identity.ProviderID != "42" {
+		t.Errorf("linked %+v, want facebook account 42 of member %d", identity, member.ID)
+	}
+
+	feeds := memDB.rows(model.TableNameFeed)
+	if len(feeds) != 1 || memString(feeds[0]["Identifier"]) != "42" {
+		t.Fatalf("created feeds %v, want the feed for account 42", feeds)
+	}
+	if actions := auditActions(); len(actions) != 2 || actions[0] != model.AuditActionLink || actions[1] != model.AuditActionCreate {
+		t.Errorf("audited %v, want link and create", actions)
+	}
+
+	// linking the same account again keeps the identity and skips the
+	// feed that already exists
+	state, cookie = startOAuth(t, rt, bearer, true)
+	if w := callbackOAuth(t, rt, state, cookie); w.Code != http.StatusOK {
+		t.Fatalf("second callback got %d, %s", w.Code, w.Body.String())
+	}
+	if n := len(memDB.rows(model.TableNameIdentity)); n != 1 {
+		t.Errorf("linking again left %d identities, want 1", n)
+	}
+	if n := len(memDB.rows(model.TableNameFeed)); n != 1 {
+		t.Errorf("linking again left %d feeds, want 1", n)
+	}
+}
+
+func TestOAuthCallbackChecksState(t *testing.T) {
+	_, bearer, teardown := setupOAuth(t)
+	defer teardown()
+	rt := APIRouter(testPrefix)
+
+	// another browser, without the cookie or with its own
+	state, _ := startOAuth(t, rt, bearer, false)
+	if w := callbackOAuth(t, rt, state, nil); w.Code != http.StatusForbidden {
+		t.Errorf("callback without the cookie got %d, want 403", w.Code)
+	}
+	state, cookie := startOAuth(t, rt, bearer, false)
+	cookie.Value = "another nonce"
+	if w := callbackOAuth(t, rt, state, cookie); w.Code != http.StatusForbidden {
+		t.Errorf("callback with another nonce got %d, want 403", w.Code)
+	}
+
+	// a state is only good once, and only if it was handed out
+	state, cookie = startOAuth(t, rt, bearer, false)
+	if w := callbackOAuth(t, rt, state, cookie); w.Code != http.StatusOK {
+		t.Fatalf("callback got %d, %s", w.Code, w.Body.String())
+	}
+	if w := callbackOAuth(t, rt, state, cookie); w.Code != http.StatusBadRequest {
+		t.Errorf("replayed callback got %d, want 400", w.Code)
+	}
+	if w := callbackOAuth(t, rt, "unknown", cookie); w.Code != http.StatusBadRequest {
+		t.Errorf("callback with an unknown state got %d, want 400", w.Code)
+	}
+	if n := len(memDB.rows(model.TableNameIdentity)); n != 1 {
+		t.Errorf("callbacks left %d identities, want 1", n)
+	}
+}
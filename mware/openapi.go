@@ -0,0 +1,429 @@
+package mware
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/SyntropyDev/httperr"
+)
+
+const (
+	openAPIVersion = "3.0.3"
+	apiTitle       = "Mobile Main Street API"
+	apiVersion     = "v1"
+
+	schemaPrefix = "#/components/schemas/"
+	errorRef     = "#/components/responses/Error"
+)
+
+// serverFields are the fields of a resource the server sets, so they're
+// left out of request bodies.
+var serverFields = map[string]bool{"ID": true, "Created": true, "Updated": true, "Object": true}
+
+// OpenAPIDoc is an OpenAPI 3 description of the routes registered with a
+// Router.
+type OpenAPIDoc struct {
+	OpenAPI    string                           `json:"openapi"`
+	Info       map[string]string                `json:"info"`
+	Paths      map[string]map[string]*operation `json:"paths"`
+	Components *components                      `json:"components"`
+}
+
+type components struct {
+	Schemas   map[string]*schema   `json:"schemas"`
+	Responses map[string]*response `json:"responses"`
+}
+
+type operation struct {
+	OperationID string               `json:"operationId"`
+	Parameters  []*parameter         `json:"parameters,omitempty"`
+	RequestBody *requestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*response `json:"responses"`
+}
+
+type parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Required    bool    `json:"required,omitempty"`
+	Description string  `json:"description,omitempty"`
+	Schema      *schema `json:"schema"`
+}
+
+type requestBody struct {
+	Required bool                  `json:"required"`
+	Content  map[string]*mediaType `json:"content"`
+}
+
+type response struct {
+	Ref         string                `json:"$ref,omitempty"`
+	Description string                `json:"description,omitempty"`
+	Content     map[string]*mediaType `json:"content,omitempty"`
+}
+
+type mediaType struct {
+	Schema *schema `json:"schema"`
+}
+
+type schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Items                *schema            `json:"items,omitempty"`
+	Properties           map[string]*schema `json:"properties,omitempty"`
+	AdditionalProperties *schema            `json:"additionalProperties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	ExclusiveMinimum     bool               `json:"exclusiveMinimum,omitempty"`
+	ExclusiveMaximum     bool               `json:"exclusiveMaximum,omitempty"`
+	MinLength            *int64             `json:"minLength,omitempty"`
+	MaxLength            *int64             `json:"maxLength,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+}
+
+// OpenAPIHandler serves the OpenAPI document for rt's routes.
+func OpenAPIHandler(rt *Router) httperr.Handler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		return json.NewEncoder(w).Encode(rt.OpenAPI())
+	}
+}
+
+// OpenAPI describes the recorded routes.  Request and response bodies come
+// from each route's resource, with json tags naming the properties and val
+// tags adding constraints: nonzero fields are required and in(...) lists
+// an enum.  Request bodies leave out the fields the server sets and the
+// embedded relations, and merge patches require nothing.
+func (rt *Router) OpenAPI() *OpenAPIDoc {
+	doc := &OpenAPIDoc{
+		OpenAPI: openAPIVersion,
+		Info:    map[string]string{"title": apiTitle, "version": apiVersion},
+		Paths:   map[string]map[string]*operation{},
+		Components: &components{
+			Schemas: map[string]*schema{},
+			Responses: map[string]*response{
+				"Error": jsonResponse("An error.", errorSchema()),
+			},
+		},
+	}
+	for _, route := range rt.routes {
+		path, params := openAPIPath(route.Path)
+		item, ok := doc.Paths[path]
+		if !ok {
+			item = map[string]*operation{}
+			doc.Paths[path] = item
+		}
+		item[strings.ToLower(route.Method)] = route.operation(params, doc.Components.Schemas)
+	}
+	return doc
+}
+
+// CheckOpenAPI returns an error if any recorded route or its resource is
+// missing from the OpenAPI document, or if two routes would share an
+// operation.
+func (rt *Router) CheckOpenAPI() error {
+	doc := rt.OpenAPI()
+	seen := map[string]bool{}
+	for _, route := range rt.routes {
+		path, _ := openAPIPath(route.Path)
+		key := route.Method + " " + path
+		if seen[key] {
+			return fmt.Errorf("mware: %s %s is registered twice", route.Method, route.Path)
+		}
+		seen[key] = true
+		if _, ok := doc.Paths[path][strings.ToLower(route.Method)]; !ok {
+			return fmt.Errorf("mware: %s %s is missing from the OpenAPI document", route.Method, route.Path)
+		}
+		if route.resource == nil {
+			continue
+		}
+		name := reflect.TypeOf(route.resource).Elem().Name()
+		if _, ok := doc.Components.Schemas[name]; !ok {
+			return fmt.Errorf("mware: %s %s's resource, %s, is missing from the OpenAPI document", route.Method, route.Path, name)
+		}
+	}
+	return nil
+}
+
+// openAPIPath converts a pat pattern's :params to {params}.
+func openAPIPath(pattern string) (string, []string) {
+	parts := strings.Split(pattern, "/")
+	params := []string{}
+	for i, part := range parts {
+		if strings.HasPrefix(part, ":") {
+			params = append(params, part[1:])
+			parts[i] = "{" + part[1:] + "}"
+		}
+	}
+	return strings.Join(parts, "/"), params
+}
+
+func (route *Route) operation(params []string, schemas map[string]*schema) *operation {
+	op := &operation{
+		OperationID: operationID(route.Method, route.Path),
+		Responses: map[string]*response{
+			"200":     {Description: "OK"},
+			"default": {Ref: errorRef},
+		},
+	}
+	for _, p := range params {
+		op.Parameters = append(op.Parameters, &parameter{
+			Name:     p,
+			In:       "path",
+			Required: true,
+			Schema:   &schema{Type: "string"},
+		})
+	}
+	if route.resource == nil {
+		return op
+	}
+
+	resource := schemaFor(reflect.TypeOf(route.resource), schemas)
+	switch {
+	case route.Method == "GET" && len(params) == 0:
+		op.Parameters = append(op.Parameters, listParameters(route.resource)...)
+		op.Responses["200"] = jsonResponse("OK", &schema{Type: "array", Items: resource})
+		return op
+	case route.Method == "PATCH":
+		op.RequestBody = &requestBody{
+			Required: true,
+			Content: map[string]*mediaType{
+				mergePatchType: {Schema: inputSchemaFor(reflect.TypeOf(route.resource), true, schemas)},
+				jsonPatchType:  {Schema: &schema{Type: "array", Items: &schema{Type: "object"}}},
+			},
+		}
+	case route.Method == "PUT" || (route.Method == "POST" && len(params) == 0):
+		op.RequestBody = &requestBody{
+			Required: true,
+			Content:  map[string]*mediaType{"application/json": {Schema: inputSchemaFor(reflect.TypeOf(route.resource), false, schemas)}},
+		}
+	}
+	op.Responses["200"] = jsonResponse("OK", resource)
+	return op
+}
+
+// operationID names an operation after its method and path, like
+// getMembersById.
+func operationID(method, pattern string) string {
+	id := strings.ToLower(method)
+	for _, part := range strings.Split(strings.TrimPrefix(pattern, prefixOf(pattern)), "/") {
+		if part == "" {
+			continue
+		}
+		if strings.HasPrefix(part, ":") {
+			part = "by-" + part[1:]
+		}
+		for _, word := range strings.FieldsFunc(part, func(r rune) bool {
+			return r == '-' || r == '.' || r == '_'
+		}) {
+			id += strings.ToUpper(word[:1]) + word[1:]
+		}
+	}
+	return id
+}
+
+// prefixOf returns the version prefix of pattern, like /api/v1.
+func prefixOf(pattern string) string {
+	parts := strings.SplitN(pattern, "/", 4)
+	if len(parts) < 4 || parts[1] != "api" {
+		return ""
+	}
+	return "/" + parts[1] + "/" + parts[2]
+}
+
+// listParameters documents the query parameters GetAll reads.
+func listParameters(m CrudResource) []*parameter {
+	str := &schema{Type: "string"}
+	params := []*parameter{
+		{Name: KeyFields, In: "query", Schema: str, Description: "Comma separated json keys to return."},
+		{Name: KeyOrder, In: "query", Schema: str, Description: "Comma separated asc-field or desc-field orderings."},
+		{Name: KeyLimit, In: "query", Schema: &schema{Type: "integer"}},
+		{Name: KeyOffset, In: "query", Schema: &schema{Type: "integer"}},
+		{Name: KeyCursor, In: "query", Schema: str, Description: "The next page's cursor from the Link header or envelope."},
+		{Name: KeyOr, In: "query", Schema: str, Description: "Filters written [op-]field:value separated by |, any of which may match."},
+		{Name: KeyEnvelope, In: "query", Schema: &schema{Type: "boolean"}},
+		{Name: KeyExpand, In: "query", Schema: str, Description: "Comma separated related resources to embed."},
+		{Name: KeyIncludeDeleted, In: "query", Schema: &schema{Type: "boolean"}},
+		{Name: KeyFormat, In: "query", Schema: &schema{Type: "string", Enum: []string{formatJSON, formatCSV, formatNDJSON}}},
+	}
+
+	objT := reflect.TypeOf(m).Elem()
+	for i := 0; i < objT.NumField(); i++ {
+		field := objT.Field(i)
+		if field.Tag.Get("filter") != "true" {
+			continue
+		}
+		params = append(params, &parameter{
+			Name:        getJsonKeyFromTag(field.Tag.Get("json")),
+			In:          "query",
+			Description: "Filter, also as op-name with op one of ne, lt, lte, gt, gte, in, like, prefix, between or isnull.",
+			Schema:      str,
+		})
+	}
+	return params
+}
+
+// schemaFor returns the schema for t, adding the schemas of the structs it
+// uses to schemas.
+func schemaFor(t reflect.Type, schemas map[string]*schema) *schema {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaFor(t.Elem(), schemas)
+	case reflect.Bool:
+		return &schema{Type: "boolean"}
+	case reflect.Int64, reflect.Uint64:
+		return &schema{Type: "integer", Format: "int64"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &schema{Type: "number"}
+	case reflect.String:
+		return &schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		return &schema{Type: "array", Items: schemaFor(t.Elem(), schemas)}
+	case reflect.Struct:
+		ref := &schema{Ref: schemaPrefix + t.Name()}
+		if _, ok := schemas[t.Name()]; ok {
+			return ref
+		}
+		// claim the name before the fields so cycles end in a ref
+		s := &schema{Type: "object", Properties: map[string]*schema{}}
+		schemas[t.Name()] = s
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			key := getJsonKeyFromTag(field.Tag.Get("json"))
+			if key == "-" || key == "" || field.PkgPath != "" {
+				continue
+			}
+			prop := schemaFor(field.Type, schemas)
+			if applyValTag(prop, field.Tag.Get("val")) {
+				s.Required = append(s.Required, key)
+			}
+			s.Properties[key] = prop
+		}
+		return ref
+	}
+	return &schema{Type: "object"}
+}
+
+// inputSchemaFor returns the schema of a request body creating or replacing
+// a t, or if partial merge patching one, adding it to schemas as tInput or
+// tPatch.
+func inputSchemaFor(t reflect.Type, partial bool, schemas map[string]*schema) *schema {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	name := t.Name() + "Input"
+	if partial {
+		name = t.Name() + "Patch"
+	}
+	ref := &schema{Ref: schemaPrefix + name}
+	if _, ok := schemas[name]; ok {
+		return ref
+	}
+
+	s := &schema{Type: "object", Properties: map[string]*schema{}}
+	schemas[name] = s
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		key := getJsonKeyFromTag(field.Tag.Get("json"))
+		if key == "-" || key == "" || field.PkgPath != "" {
+			continue
+		}
+		if serverFields[field.Name] || isRelation(field.Type) {
+			continue
+		}
+		prop := schemaFor(field.Type, schemas)
+		if applyValTag(prop, field.Tag.Get("val")) && !partial {
+			s.Required = append(s.Required, key)
+		}
+		s.Properties[key] = prop
+	}
+	return ref
+}
+
+// isRelation returns true if t holds other resources, like a member's
+// feeds, which are embedded in responses but can't be written with them.
+func isRelation(t reflect.Type) bool {
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Struct
+}
+
+// applyValTag adds the constraints in a val tag to s and returns true if
+// the field is required.
+func applyValTag(s *schema, tag string) bool {
+	required := false
+	for _, rule := range strings.Split(tag, "|") {
+		rule = strings.TrimSpace(rule)
+		name, arg := rule, ""
+		if i := strings.Index(rule, "("); i >= 0 && strings.HasSuffix(rule, ")") {
+			name, arg = rule[:i], rule[i+1:len(rule)-1]
+		}
+
+		switch name {
+		case "nonzero":
+			required = true
+		case "in":
+			s.Enum = strings.Split(arg, ",")
+		case "email":
+			s.Format = "email"
+		case "url":
+			s.Format = "uri"
+		case "lat":
+			s.Minimum, s.Maximum = float(-90), float(90)
+		case "lon":
+			s.Minimum, s.Maximum = float(-180), float(180)
+		case "gt", "gte":
+			if n, err := strconv.ParseFloat(arg, 64); err == nil {
+				s.Minimum, s.ExclusiveMinimum = &n, name == "gt"
+			}
+		case "lt", "lte":
+			if n, err := strconv.ParseFloat(arg, 64); err == nil {
+				s.Maximum, s.ExclusiveMaximum = &n, name == "lt"
+			}
+		case "minlen":
+			if n, err := strconv.ParseInt(arg, 10, 64); err == nil {
+				s.MinLength = &n
+			}
+		case "maxlen":
+			if n, err := strconv.ParseInt(arg, 10, 64); err == nil {
+				s.MaxLength = &n
+			}
+		case "matches":
+			s.Pattern = arg
+		}
+	}
+	return required
+}
+
+func float(f float64) *float64 {
+	return &f
+}
+
+func jsonResponse(description string, s *schema) *response {
+	return &response{
+		Description: description,
+		Content:     map[string]*mediaType{"application/json": {Schema: s}},
+	}
+}
+
+// errorSchema describes the json written for a failed request.
+func errorSchema() *schema {
+	return &schema{
+		Type: "object",
+		Properties: map[string]*schema{
+			"code":      {Type: "string"},
+			"message":   {Type: "string"},
+			"fields":    {Type: "object", AdditionalProperties: &schema{Type: "string"}},
+			"requestId": {Type: "string"},
+		},
+		Required: []string{"code", "message"},
+	}
+}
@@ -0,0 +1,111 @@
+package mware
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+const testPrefix = "/api/v1"
+
+// muxOperations walks the handlers registered with rt's pat mux and
+// returns each as method and OpenAPI path.  Preflights and the HEAD
+// handlers pat adds for GETs aren't part of the document.
+func muxOperations(rt *Router) []string {
+	ops := []string{}
+	handlers := reflect.ValueOf(rt.mux).Elem().FieldByName("handlers")
+	for _, method := range handlers.MapKeys() {
+		if method.String() == "OPTIONS" || method.String() == "HEAD" {
+			continue
+		}
+		list := handlers.MapIndex(method)
+		for i := 0; i < list.Len(); i++ {
+			path, _ := openAPIPath(list.Index(i).Elem().FieldByName("pat").String())
+			ops = append(ops, method.String()+" "+path)
+		}
+	}
+	sort.Strings(ops)
+	return ops
+}
+
+func TestOpenAPIMatchesRoutes(t *testing.T) {
+	rt := APIRouter(testPrefix)
+	if err := rt.CheckOpenAPI(); err != nil {
+		t.Fatal(err)
+	}
+
+	doc := rt.OpenAPI()
+	documented := []string{}
+	ids := map[string]string{}
+	for path, item := range doc.Paths {
+		for method, op := range item {
+			key := strings.ToUpper(method) + " " + path
+			documented = append(documented, key)
+			if other, ok := ids[op.OperationID]; ok {
+				t.Errorf("%s and %s share the operation id %s", other, key, op.OperationID)
+			}
+			ids[op.OperationID] = key
+		}
+	}
+	sort.Strings(documented)
+
+	served := muxOperations(rt)
+	if !reflect.DeepEqual(served, documented) {
+		t.Errorf("routes served and documented differ\nserved:     %v\ndocumented: %v", served, documented)
+	}
+}
+
+func TestOpenAPIPathParameters(t *testing.T) {
+	doc := APIRouter(testPrefix).OpenAPI()
+	for path, item := range doc.Paths {
+		_, want := openAPIPath(strings.Replace(strings.Replace(path, "{", ":", -1), "}", "", -1))
+		for method, op := range item {
+			got := []string{}
+			for _, p := range op.Parameters {
+				if p.In == "path" {
+					got = append(got, p.Name)
+				}
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s %s has path parameters %v, want %v", method, path, got, want)
+			}
+		}
+	}
+}
+
+func TestOpenAPIRequestBodies(t *testing.T) {
+	doc := APIRouter(testPrefix).OpenAPI()
+	member := testPrefix + "/members/{id}"
+
+	patch := doc.Paths[member]["patch"].RequestBody.Content[mergePatchType].Schema
+	if patch.Ref != schemaPrefix+"MemberPatch" {
+		t.Fatalf("merge patch schema is %s, want MemberPatch", patch.Ref)
+	}
+	put := doc.Paths[member]["put"].RequestBody.Content["application/json"].Schema
+	if put.Ref != schemaPrefix+"MemberInput" {
+		t.Fatalf("put schema is %s, want MemberInput", put.Ref)
+	}
+
+	input := doc.Components.Schemas["MemberInput"]
+	patchInput := doc.Components.Schemas["MemberPatch"]
+	for _, key := range []string{"id", "created", "updated", "object", "feeds"} {
+		if _, ok := input.Properties[key]; ok {
+			t.Errorf("MemberInput has %s", key)
+		}
+		if _, ok := patchInput.Properties[key]; ok {
+			t.Errorf("MemberPatch has %s", key)
+		}
+	}
+	if !reflect.DeepEqual(input.Required, []string{"name"}) {
+		t.Errorf("MemberInput requires %v, want [name]", input.Required)
+	}
+	if len(patchInput.Required) > 0 {
+		t.Errorf("MemberPatch requires %v, want nothing", patchInput.Required)
+	}
+
+	// responses still describe the whole resource
+	if _, ok := doc.Components.Schemas["Member"].Properties["created"]; !ok {
+		t.Error("Member is missing created")
+	}
+}
@@ -0,0 +1,512 @@
+package mware
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/SyntropyDev/httperr"
+	"github.com/SyntropyDev/mms-api/model"
+)
+
+const (
+	mergePatchType = "application/merge-patch+json"
+	jsonPatchType  = "application/json-patch+json"
+)
+
+// PatchByID changes only the fields named in the request body, so unlike
+// UpdateByID it can set a field to its zero value.  The body is an RFC 7396
+// merge patch, or an RFC 6902 json patch when sent as
+// application/json-patch+json.  Either way only fields tagged merge:"true"
+// may be changed.
+func PatchByID(m CrudResource) httperr.Handler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		dbmap, err := getDB()
+		defer dbmap.Db.Close()
+		if err != nil {
+			return err
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return clientError(err)
+		}
+
+		trans, err := dbmap.Begin()
+		if err != nil {
+			return err
+		}
+
+		id := r.URL.Query().Get(":id")
+		mCopy := copyResource(m)
+		if err := lockID(trans, mCopy, id); err != nil {
+			trans.Rollback()
+			return err
+		}
+		if err := authorize(r, mCopy); err != nil {
+			trans.Rollback()
+			return err
+		}
+		if err := checkIfMatch(r, mCopy); err != nil {
+			trans.Rollback()
+			return err
+		}
+		before, err := model.Snapshot(mCopy)
+		if err != nil {
+			trans.Rollback()
+			return err
+		}
+
+		if err := applyPatch(mCopy, r.Header.Get("Content-Type"), body); err != nil {
+			trans.Rollback()
+			return err
+		}
+
+		// prevent members from handing their resources to someone else
+		if err := authorize(r, mCopy); err != nil {
+			trans.Rollback()
+			return err
+		}
+
+		if _, err := trans.Update(mCopy); err != nil {
+			trans.Rollback()
+			return saveError(mCopy, err)
+		}
+		if err := audit(trans, r, model.AuditActionUpdate, mCopy, before, mCopy); err != nil {
+			trans.Rollback()
+			return err
+		}
+		if err := expand(trans, r, mCopy); err != nil {
+			trans.Rollback()
+			return err
+		}
+
+		if err := trans.Commit(); err != nil {
+			return err
+		}
+		setValidators(w, r, mCopy)
+		return json.NewEncoder(w).Encode(mCopy)
+	}
+}
+
+// applyPatch applies body, a patch of the given content type, to m's
+// patchable fields and validates the result.
+func applyPatch(m CrudResource, contentType string, body []byte) error {
+	fields := patchFields(m)
+	doc, err := patchDocument(m, fields)
+	if err != nil {
+		return err
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case jsonPatchType:
+		ops := []*patchOp{}
+		if err := decodeJSON(body, &ops); err != nil {
+			return clientError(err)
+		}
+		for i, op := range ops {
+			if err := op.check(fields); err != nil {
+				return err
+			}
+			if doc, err = op.apply(doc); err != nil {
+				message := fmt.Sprintf("json patch operation %d failed: %s", i, err)
+				code := http.StatusUnprocessableEntity
+				if op.Op == "test" {
+					code = http.StatusConflict
+				}
+				return httperr.New(code, message, err)
+			}
+		}
+	case "", "application/json", mergePatchType:
+		var patch interface{}
+		if err := decodeJSON(body, &patch); err != nil {
+			return clientError(err)
+		}
+		obj, ok := patch.(map[string]interface{})
+		if !ok {
+			err := errors.New("merge patch must be a json object")
+			return httperr.New(http.StatusBadRequest, err.Error(), err)
+		}
+		rejected := map[string]string{}
+		for key := range obj {
+			if _, ok := fields[key]; !ok {
+				rejected[key] = "can't be changed"
+			}
+		}
+		if len(rejected) > 0 {
+			return model.NewFieldsError(http.StatusBadRequest, "patch changes fields that can't be changed", rejected)
+		}
+		doc = mergePatch(doc, obj)
+	default:
+		err := fmt.Errorf("unsupported patch type %s", mediaType)
+		return httperr.New(http.StatusUnsupportedMediaType, err.Error(), err)
+	}
+
+	obj, ok := doc.(map[string]interface{})
+	if !ok {
+		err := errors.New("patch must leave a json object")
+		return httperr.New(http.StatusBadRequest, err.Error(), err)
+	}
+	if rejected := setPatchFields(m, fields, obj); len(rejected) > 0 {
+		return model.NewFieldsError(http.StatusBadRequest, "patch sets fields to invalid values", rejected)
+	}
+	if rejected := model.ValidationFields(m); len(rejected) > 0 {
+		message := fmt.Sprintf("%s did not pass validation.", m.TableName())
+		return model.NewFieldsError(http.StatusBadRequest, message, rejected)
+	}
+	return nil
+}
+
+// patchFields maps the json names of m's merge:"true" fields to their
+// struct indexes.
+func patchFields(m CrudResource) map[string]int {
+	fields := map[string]int{}
+	objT := reflect.TypeOf(m).Elem()
+	for i := 0; i < objT.NumField(); i++ {
+		field := objT.Field(i)
+		if field.Tag.Get("merge") != "true" {
+			continue
+		}
+		if key := getJsonKeyFromTag(field.Tag.Get("json")); key != "-" && key != "" {
+			fields[key] = i
+		}
+	}
+	return fields
+}
+
+// patchDocument returns m's patchable fields as a generic json object for
+// patches to be applied to.
+func patchDocument(m CrudResource, fields map[string]int) (interface{}, error) {
+	mV := reflect.ValueOf(m).Elem()
+	values := map[string]interface{}{}
+	for key, i := range fields {
+		values[key] = mV.Field(i).Interface()
+	}
+	b, err := json.Marshal(values)
+	if err != nil {
+		return nil, err
+	}
+	var doc interface{}
+	return doc, decodeJSON(b, &doc)
+}
+
+// setPatchFields copies the patched document back into m.  Fields missing
+// from the document are set to their zero value.  It returns the fields
+// whose values don't fit.
+func setPatchFields(m CrudResource, fields map[string]int, doc map[string]interface{}) map[string]string {
+	rejected := map[string]string{}
+	mV := reflect.ValueOf(m).Elem()
+	for key, i := range fields {
+		field := mV.Field(i)
+		v, ok := doc[key]
+		if !ok || v == nil {
+			field.Set(reflect.Zero(field.Type()))
+			continue
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			rejected[key] = err.Error()
+			continue
+		}
+		ptr := reflect.New(field.Type())
+		if err := json.Unmarshal(b, ptr.Interface()); err != nil {
+			rejected[key] = fmt.Sprintf("must be a %s", jsonTypeName(field.Type()))
+			continue
+		}
+		field.Set(ptr.Elem())
+	}
+	return rejected
+}
+
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.String:
+		return "string"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	}
+	return "object"
+}
+
+// decodeJSON decodes b keeping numbers exact, so large ids survive being
+// copied through a generic document.
+func decodeJSON(b []byte, v interface{}) error {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	return d.Decode(v)
+}
+
+// mergePatch applies an RFC 7396 merge patch to target.
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = map[string]interface{}{}
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = mergePatch(t[k], v)
+		}
+	}
+	return t
+}
+
+// patchOp is one RFC 6902 json patch operation.
+type patchOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	From  string      `json:"from"`
+	Value interface{} `json:"value"`
+}
+
+// check returns an error unless op only touches patchable fields.
+func (op *patchOp) check(fields map[string]int) error {
+	paths := []string{op.Path}
+	if op.Op == "move" || op.Op == "copy" {
+		paths = append(paths, op.From)
+	}
+	for _, path := range paths {
+		ptr, err := parsePointer(path)
+		if err != nil {
+			return httperr.New(http.StatusBadRequest, err.Error(), err)
+		}
+		if len(ptr) == 0 {
+			err := errors.New("json patch can't replace the whole resource")
+			return httperr.New(http.StatusBadRequest, err.Error(), err)
+		}
+		if _, ok := fields[ptr[0]]; !ok {
+			return model.NewFieldsError(http.StatusBadRequest, "patch changes fields that can't be changed", map[string]string{
+				ptr[0]: "can't be changed",
+			})
+		}
+	}
+	return nil
+}
+
+func (op *patchOp) apply(doc interface{}) (interface{}, error) {
+	path, _ := parsePointer(op.Path)
+	from, _ := parsePointer(op.From)
+
+	switch op.Op {
+	case "add":
+		return path.update(doc, addValue(op.Value))
+	case "remove":
+		return path.update(doc, removeValue)
+	case "replace":
+		return path.update(doc, replaceValue(op.Value))
+	case "move":
+		v, err := from.get(doc)
+		if err != nil {
+			return nil, err
+		}
+		if doc, err = from.update(doc, removeValue); err != nil {
+			return nil, err
+		}
+		return path.update(doc, addValue(v))
+	case "copy":
+		v, err := from.get(doc)
+		if err != nil {
+			return nil, err
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		var dup interface{}
+		if err := decodeJSON(b, &dup); err != nil {
+			return nil, err
+		}
+		return path.update(doc, addValue(dup))
+	case "test":
+		v, err := path.get(doc)
+		if err != nil {
+			return nil, err
+		}
+		if !jsonEqual(v, op.Value) {
+			return nil, fmt.Errorf("%s doesn't match", op.Path)
+		}
+		return doc, nil
+	}
+	return nil, fmt.Errorf("unknown op %q", op.Op)
+}
+
+// jsonPointer is a parsed RFC 6901 json pointer.
+type jsonPointer []string
+
+func parsePointer(s string) (jsonPointer, error) {
+	if s == "" {
+		return jsonPointer{}, nil
+	}
+	if !strings.HasPrefix(s, "/") {
+		return nil, fmt.Errorf("json pointer %q must start with /", s)
+	}
+	ptr := jsonPointer{}
+	for _, tok := range strings.Split(s[1:], "/") {
+		tok = strings.Replace(tok, "~1", "/", -1)
+		tok = strings.Replace(tok, "~0", "~", -1)
+		ptr = append(ptr, tok)
+	}
+	return ptr, nil
+}
+
+func (p jsonPointer) get(doc interface{}) (interface{}, error) {
+	for _, tok := range p {
+		switch c := doc.(type) {
+		case map[string]interface{}:
+			v, ok := c[tok]
+			if !ok {
+				return nil, fmt.Errorf("%s not found", tok)
+			}
+			doc = v
+		case []interface{}:
+			i, err := arrayIndex(tok, len(c)-1)
+			if err != nil {
+				return nil, err
+			}
+			doc = c[i]
+		default:
+			return nil, fmt.Errorf("%s not found", tok)
+		}
+	}
+	return doc, nil
+}
+
+// update replaces the container holding p's last token with the result of
+// calling f on it.
+func (p jsonPointer) update(doc interface{}, f func(parent interface{}, key string) (interface{}, error)) (interface{}, error) {
+	if len(p) == 1 {
+		return f(doc, p[0])
+	}
+	switch c := doc.(type) {
+	case map[string]interface{}:
+		child, ok := c[p[0]]
+		if !ok {
+			return nil, fmt.Errorf("%s not found", p[0])
+		}
+		v, err := p[1:].update(child, f)
+		if err != nil {
+			return nil, err
+		}
+		c[p[0]] = v
+		return c, nil
+	case []interface{}:
+		i, err := arrayIndex(p[0], len(c)-1)
+		if err != nil {
+			return nil, err
+		}
+		v, err := p[1:].update(c[i], f)
+		if err != nil {
+			return nil, err
+		}
+		c[i] = v
+		return c, nil
+	}
+	return nil, fmt.Errorf("%s not found", p[0])
+}
+
+func addValue(v interface{}) func(interface{}, string) (interface{}, error) {
+	return func(parent interface{}, key string) (interface{}, error) {
+		switch c := parent.(type) {
+		case map[string]interface{}:
+			c[key] = v
+			return c, nil
+		case []interface{}:
+			if key == "-" {
+				return append(c, v), nil
+			}
+			i, err := arrayIndex(key, len(c))
+			if err != nil {
+				return nil, err
+			}
+			c = append(c, nil)
+			copy(c[i+1:], c[i:])
+			c[i] = v
+			return c, nil
+		}
+		return nil, fmt.Errorf("can't add %s", key)
+	}
+}
+
+func removeValue(parent interface{}, key string) (interface{}, error) {
+	switch c := parent.(type) {
+	case map[string]interface{}:
+		if _, ok := c[key]; !ok {
+			return nil, fmt.Errorf("%s not found", key)
+		}
+		delete(c, key)
+		return c, nil
+	case []interface{}:
+		i, err := arrayIndex(key, len(c)-1)
+		if err != nil {
+			return nil, err
+		}
+		return append(c[:i], c[i+1:]...), nil
+	}
+	return nil, fmt.Errorf("%s not found", key)
+}
+
+func replaceValue(v interface{}) func(interface{}, string) (interface{}, error) {
+	return func(parent interface{}, key string) (interface{}, error) {
+		switch c := parent.(type) {
+		case map[string]interface{}:
+			if _, ok := c[key]; !ok {
+				return nil, fmt.Errorf("%s not found", key)
+			}
+			c[key] = v
+			return c, nil
+		case []interface{}:
+			i, err := arrayIndex(key, len(c)-1)
+			if err != nil {
+				return nil, err
+			}
+			c[i] = v
+			return c, nil
+		}
+		return nil, fmt.Errorf("%s not found", key)
+	}
+}
+
+// arrayIndex parses an array index token no greater than max.
+func arrayIndex(tok string, max int) (int, error) {
+	i, err := strconv.Atoi(tok)
+	if err != nil || i < 0 || i > max || (tok != "0" && strings.HasPrefix(tok, "0")) {
+		return 0, fmt.Errorf("array index %s invalid", tok)
+	}
+	return i, nil
+}
+
+// jsonEqual compares two decoded json values, treating numbers as equal
+// when their values are.
+func jsonEqual(a, b interface{}) bool {
+	ab, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	bb, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	var an, bn interface{}
+	json.Unmarshal(ab, &an)
+	json.Unmarshal(bb, &bn)
+	return reflect.DeepEqual(an, bn)
+}
@@ -0,0 +1,59 @@
+package mware
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/SyntropyDev/httperr"
+)
+
+// Owned is implemented by resources that belong to a single member.  Members
+// who aren't organizers may only modify the resources they own.
+type Owned interface {
+	OwnerID() int64
+}
+
+// Organizer only allows authenticated organizers through to h.  It must be
+// wrapped by Auth.
+func Organizer(h httperr.Handler) httperr.Handler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		member := CurrentMember(r)
+		if member == nil {
+			return errNotAuthorized()
+		}
+		if !member.Organizer {
+			return errForbidden()
+		}
+		return h(w, r)
+	}
+}
+
+// authorize returns an error unless the authenticated member may modify m.
+// Api keys are only let through by AuthScope once their scope is checked, so
+// they may modify anything the route allows.
+func authorize(r *http.Request, m CrudResource) error {
+	if CurrentAPIKey(r) != nil {
+		return nil
+	}
+	member := CurrentMember(r)
+	if member == nil {
+		return errNotAuthorized()
+	}
+	if member.Organizer {
+		return nil
+	}
+	if owned, ok := m.(Owned); ok && owned.OwnerID() == member.ID {
+		return nil
+	}
+	return errForbidden()
+}
+
+func errNotAuthorized() error {
+	err := errors.New("not authorized")
+	return httperr.New(http.StatusUnauthorized, err.Error(), err)
+}
+
+func errForbidden() error {
+	err := errors.New("forbidden")
+	return httperr.New(http.StatusForbidden, err.Error(), err)
+}
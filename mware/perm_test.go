@@ -0,0 +1,42 @@
+package mware
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/SyntropyDev/httperr"
+	"github.com/SyntropyDev/mms-api/model"
+)
+
+func TestCreateMemberIsOrganizerOnly(t *testing.T) {
+	r, err := http.NewRequest("POST", testPrefix+"/members", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setContext(r, &requestContext{member: &model.Member{ID: 5}})
+	defer clearContext(r)
+
+	// the member claims the new member by sending their own id; the
+	// insert is never reached, so no database is needed
+	err = createResource(nil, r, &model.Member{ID: 5, Name: "someone"})
+	e, ok := err.(httperr.Error)
+	if !ok || e.StatusCode() != http.StatusForbidden {
+		t.Fatalf("create returned %v, want 403", err)
+	}
+}
+
+func TestAuthorizeOwnedResource(t *testing.T) {
+	r, err := http.NewRequest("PUT", testPrefix+"/feeds/1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setContext(r, &requestContext{member: &model.Member{ID: 5}})
+	defer clearContext(r)
+
+	if err := authorize(r, &model.Feed{ID: 1, MemberID: 5}); err != nil {
+		t.Errorf("owner was refused: %v", err)
+	}
+	if err := authorize(r, &model.Feed{ID: 2, MemberID: 6}); err == nil {
+		t.Error("another member's feed was allowed")
+	}
+}
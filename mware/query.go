@@ -0,0 +1,444 @@
+package mware
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/SyntropyDev/httperr"
+	"github.com/coopernurse/gorp"
+	"github.com/lann/squirrel"
+)
+
+const (
+	KeyOrder  = "q-order"
+	KeyLimit  = "q-limit"
+	KeyOffset = "q-offset"
+	KeyCursor = "q-cursor"
+	KeyOr     = "q-or"
+
+	defaultLimit = 1000
+)
+
+var (
+	// controlKeys are the query parameters that aren't filters.
+	controlKeys = map[string]bool{
+		KeyOrder:          true,
+		KeyLimit:          true,
+		KeyOffset:         true,
+		KeyCursor:         true,
+		KeyOr:             true,
+		KeyFields:         true,
+		KeyEnvelope:       true,
+		KeyExpand:         true,
+		KeyIncludeDeleted: true,
+		KeyFormat:         true,
+		authEmailKey:      true,
+		authTokenKey:      true,
+	}
+)
+
+// listQuery is a list request's filters, ordering and page, parsed from
+// the query string.  It can also count the matching rows and continue from
+// a keyset cursor.
+//
+// Each filter parameter is [op-]field=value, where op is one of eq (the
+// default), ne, lt, lte, gt, gte, in, like, prefix, between or isnull.  The
+// filters are and-ed together.  Each q-or parameter holds filters written
+// as [op-]field:value separated by |, any of which may match.  Only fields
+// tagged filter:"true" may be filtered or ordered on.
+type listQuery struct {
+	table string
+	// resource is the type being listed, which the cursor values are
+	// checked against
+	resource CrudResource
+	filters  []where
+	// orders always end with ID so every row has a distinct position
+	orders []order
+	limit  uint64
+	offset uint64
+	cursor *cursor
+}
+
+type where struct {
+	pred interface{}
+	args []interface{}
+}
+
+type order struct {
+	field string
+	desc  bool
+}
+
+// cursor marks the last row of a page so the next page can start after it
+// with a keyset comparison instead of an offset.  Rows inserted before the
+// cursor don't shift the pages that follow, and deep pages stay as fast as
+// the first.
+type cursor struct {
+	// Order is the ordering the cursor was made for
+	Order  string        `json:"o"`
+	Values []interface{} `json:"v"`
+}
+
+func newListQuery(m CrudResource, values url.Values) (*listQuery, error) {
+	q := &listQuery{table: m.TableName(), resource: m}
+
+	for key, value := range values {
+		if controlKeys[key] || strings.HasPrefix(key, ":") {
+			continue
+		}
+		pred, args, err := filterExpr(m, key, value[0])
+		if err != nil {
+			return nil, err
+		}
+		q.where(pred, args...)
+	}
+
+	for _, group := range values[KeyOr] {
+		preds, args := []string{}, []interface{}{}
+		for _, alt := range strings.Split(group, "|") {
+			parts := strings.SplitN(alt, ":", 2)
+			if len(parts) != 2 {
+				return nil, errFilter("q-or filter, %v, must be written field:value.", alt)
+			}
+			pred, altArgs, err := filterExpr(m, parts[0], parts[1])
+			if err != nil {
+				return nil, err
+			}
+			preds = append(preds, "("+pred+")")
+			args = append(args, altArgs...)
+		}
+		q.where("("+strings.Join(preds, " OR ")+")", args...)
+	}
+
+	if oVal := values.Get(KeyOrder); oVal != "" {
+		for _, o := range strings.Split(oVal, ",") {
+			parts := strings.SplitN(o, "-", 2)
+			if len(parts) != 2 {
+				return nil, errFilter("q-order, %v, must be written asc-field or desc-field.", o)
+			}
+			field, err := filterField(m, parts[1])
+			if err != nil {
+				return nil, err
+			}
+			switch parts[0] {
+			case "asc":
+				q.orderBy(field, false)
+			case "desc":
+				q.orderBy(field, true)
+			default:
+				return nil, errFilter("q-order ordering, %v, is invalid.  Must use asc or desc.", parts[0])
+			}
+		}
+	}
+	q.orderBy("ID", false)
+
+	if err := q.parsePage(values, defaultLimit); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// filterExpr returns the sql condition for the filter key=value.
+func filterExpr(m CrudResource, key, value string) (string, []interface{}, error) {
+	op, name := "eq", key
+	if i := strings.Index(key, "-"); i >= 0 {
+		op, name = key[:i], key[i+1:]
+	}
+	field, err := filterField(m, name)
+	if err != nil {
+		return "", nil, err
+	}
+
+	switch op {
+	case "eq":
+		return field + " = ?", []interface{}{value}, nil
+	case "ne":
+		return field + " <> ?", []interface{}{value}, nil
+	case "lt":
+		return field + " < ?", []interface{}{value}, nil
+	case "lte":
+		return field + " <= ?", []interface{}{value}, nil
+	case "gt":
+		return field + " > ?", []interface{}{value}, nil
+	case "gte":
+		return field + " >= ?", []interface{}{value}, nil
+	case "in":
+		args := []interface{}{}
+		for _, v := range strings.Split(value, ",") {
+			args = append(args, v)
+		}
+		return field + " IN (" + squirrel.Placeholders(len(args)) + ")", args, nil
+	case "like":
+		// * matches any run of characters
+		pattern := strings.Replace(escapeLike(value), "*", "%", -1)
+		return field + " LIKE ?", []interface{}{pattern}, nil
+	case "prefix":
+		return field + " LIKE ?", []interface{}{escapeLike(value) + "%"}, nil
+	case "between":
+		bounds := strings.Split(value, ",")
+		if len(bounds) != 2 {
+			return "", nil, errFilter("between filter on %v needs two values separated by a comma.", name)
+		}
+		return field + " BETWEEN ? AND ?", []interface{}{bounds[0], bounds[1]}, nil
+	case "isnull":
+		isNull, err := strconv.ParseBool(value)
+		if err != nil {
+			return "", nil, errFilter("isnull filter on %v must be true or false.", name)
+		}
+		if isNull {
+			return field + " IS NULL", nil, nil
+		}
+		return field + " IS NOT NULL", nil, nil
+	}
+	return "", nil, errFilter("filter operator, %v, is invalid.", op)
+}
+
+// filterField returns the column for key, a field or json name matched
+// regardless of case, if it may be filtered on.
+func filterField(m CrudResource, key string) (string, error) {
+	lower := strings.ToLower(key)
+	objT := reflect.TypeOf(m).Elem()
+	for i := 0; i < objT.NumField(); i++ {
+		field := objT.Field(i)
+		jsonKey := strings.ToLower(getJsonKeyFromTag(field.Tag.Get("json")))
+		if strings.ToLower(field.Name) != lower && jsonKey != lower {
+			continue
+		}
+		if field.Tag.Get("db") == "-" || field.Tag.Get("filter") != "true" {
+			return "", errFilter("%v can't be filtered on.", key)
+		}
+		return field.Name, nil
+	}
+	return "", errFilter("field, %v, isn't present in %v.", key, m.TableName())
+}
+
+func escapeLike(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, "%", `\%`, -1)
+	return strings.Replace(s, "_", `\_`, -1)
+}
+
+func errFilter(format string, a ...interface{}) error {
+	err := fmt.Errorf("mware: "+format, a...)
+	return httperr.New(http.StatusBadRequest, err.Error(), err)
+}
+
+func (q *listQuery) where(pred interface{}, args ...interface{}) {
+	q.filters = append(q.filters, where{pred: pred, args: args})
+}
+
+// orderBy adds field to the ordering, unless it's already there.
+func (q *listQuery) orderBy(field string, desc bool) {
+	for _, o := range q.orders {
+		if o.field == field {
+			return
+		}
+	}
+	q.orders = append(q.orders, order{field: field, desc: desc})
+}
+
+// orderKey describes the ordering so a cursor can be matched to it.
+func (q *listQuery) orderKey() string {
+	parts := []string{}
+	for _, o := range q.orders {
+		dir := "asc"
+		if o.desc {
+			dir = "desc"
+		}
+		parts = append(parts, o.field+" "+dir)
+	}
+	return strings.Join(parts, ",")
+}
+
+// parsePage reads the limit, offset and cursor.  A cursor takes the place
+// of the offset and must come from a list with the same ordering, with a
+// value of the right kind for each ordered field.
+func (q *listQuery) parsePage(values url.Values, limit uint64) error {
+	q.limit = uintFromKey(values, KeyLimit, limit)
+	q.offset = uintFromKey(values, KeyOffset, 0)
+
+	raw := values.Get(KeyCursor)
+	if raw == "" {
+		return nil
+	}
+	b, err := base64.URLEncoding.DecodeString(raw)
+	if err != nil {
+		return errFilter("q-cursor invalid.")
+	}
+	c := &cursor{}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	if err := d.Decode(c); err != nil {
+		return errFilter("q-cursor invalid.")
+	}
+	if c.Order != q.orderKey() || len(c.Values) != len(q.orders) {
+		return errFilter("q-cursor doesn't match q-order.")
+	}
+	objT := reflect.TypeOf(q.resource).Elem()
+	for i, o := range q.orders {
+		field, _ := objT.FieldByName(o.field)
+		v, ok := cursorValue(field.Type.Kind(), c.Values[i])
+		if !ok {
+			return errFilter("q-cursor value for %v is invalid.", o.field)
+		}
+		c.Values[i] = v
+	}
+	q.cursor = c
+	return nil
+}
+
+// cursorValue converts v, decoded from a cursor's json, to a field of the
+// given kind.  It returns false if v can't be one.
+func cursorValue(kind reflect.Kind, v interface{}) (interface{}, bool) {
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, ok := v.(json.Number)
+		if !ok {
+			return nil, false
+		}
+		i, err := n.Int64()
+		return i, err == nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, ok := v.(json.Number)
+		if !ok {
+			return nil, false
+		}
+		u, err := strconv.ParseUint(n.String(), 10, 64)
+		return u, err == nil
+	case reflect.Float32, reflect.Float64:
+		n, ok := v.(json.Number)
+		if !ok {
+			return nil, false
+		}
+		f, err := n.Float64()
+		return f, err == nil
+	case reflect.String:
+		str, ok := v.(string)
+		return str, ok
+	case reflect.Bool:
+		b, ok := v.(bool)
+		return b, ok
+	}
+	return nil, false
+}
+
+func (q *listQuery) builder(columns ...string) squirrel.SelectBuilder {
+	builder := squirrel.Select(columns...).From(q.table)
+	for _, f := range q.filters {
+		builder = builder.Where(f.pred, f.args...)
+	}
+	return builder
+}
+
+// ToSql returns the query for the page, plus one row that tells whether
+// another page follows.
+func (q *listQuery) ToSql() (string, []interface{}, error) {
+	builder := q.builder("*")
+
+	if c := q.cursor; c != nil {
+		// rows after the cursor in the ordering: greater on the first
+		// field, or equal on it and greater on the next, and so on
+		ors, args := []string{}, []interface{}{}
+		for i, o := range q.orders {
+			ands := []string{}
+			for j := 0; j < i; j++ {
+				ands = append(ands, q.orders[j].field+" = ?")
+				args = append(args, c.Values[j])
+			}
+			cmp := ">"
+			if o.desc {
+				cmp = "<"
+			}
+			ands = append(ands, o.field+" "+cmp+" ?")
+			args = append(args, c.Values[i])
+			ors = append(ors, "("+strings.Join(ands, " AND ")+")")
+		}
+		builder = builder.Where("("+strings.Join(ors, " OR ")+")", args...)
+	} else {
+		builder = builder.Offset(q.offset)
+	}
+
+	orderBys := []string{}
+	for _, o := range q.orders {
+		if o.desc {
+			orderBys = append(orderBys, o.field+" desc")
+		} else {
+			orderBys = append(orderBys, o.field+" asc")
+		}
+	}
+	return builder.OrderBy(orderBys...).Limit(q.limit + 1).ToSql()
+}
+
+// count returns the number of rows matching the filters on every page.
+func (q *listQuery) count(s gorp.SqlExecutor) (int64, error) {
+	sql, args, err := q.builder("count(*)").ToSql()
+	if err != nil {
+		return 0, err
+	}
+	return s.SelectInt(sql, args...)
+}
+
+// page trims the extra row selected by ToSql and returns the cursor for
+// the next page, or "" if this is the last.
+func (q *listQuery) page(models []interface{}) ([]interface{}, string) {
+	models, c := q.next(models)
+	if c == nil {
+		return models, ""
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return models, ""
+	}
+	return models, base64.URLEncoding.EncodeToString(b)
+}
+
+// next trims the extra row selected by ToSql and returns the cursor for the
+// next page, or nil if this is the last.
+func (q *listQuery) next(models []interface{}) ([]interface{}, *cursor) {
+	if uint64(len(models)) <= q.limit {
+		return models, nil
+	}
+	models = models[:q.limit]
+	if len(models) == 0 {
+		return models, nil
+	}
+
+	last := reflect.ValueOf(models[len(models)-1]).Elem()
+	c := &cursor{Order: q.orderKey()}
+	for _, o := range q.orders {
+		c.Values = append(c.Values, last.FieldByName(o.field).Interface())
+	}
+	return models, c
+}
+
+func uintFromKey(values url.Values, key string, d uint64) uint64 {
+	v := values.Get(key)
+	i, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || i < 0 {
+		return d
+	}
+	return uint64(i)
+}
+
+// structField returns the name of m's field matching key regardless of
+// case.
+func structField(m interface{}, key string) (string, bool) {
+	objT := reflect.TypeOf(m).Elem()
+	for i := 0; i < objT.NumField(); i++ {
+		field := objT.Field(i)
+		if field.Tag.Get("db") == "-" {
+			continue
+		}
+		if strings.ToLower(field.Name) == strings.ToLower(key) {
+			return field.Name, true
+		}
+	}
+	return "", false
+}
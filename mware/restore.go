@@ -0,0 +1,111 @@
+package mware
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+
+	"github.com/SyntropyDev/httperr"
+	"github.com/SyntropyDev/mms-api/model"
+	"github.com/coopernurse/gorp"
+)
+
+const (
+	KeyIncludeDeleted = "q-includeDeleted"
+)
+
+// Restorable is implemented by resources whose soft delete can be undone.
+type Restorable interface {
+	Restore()
+}
+
+// RestoreByID undoes DeleteByID.
+func RestoreByID(m CrudResource) httperr.Handler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		dbmap, err := getDB()
+		defer dbmap.Db.Close()
+		if err != nil {
+			return err
+		}
+
+		trans, err := dbmap.Begin()
+		if err != nil {
+			return err
+		}
+
+		id := r.URL.Query().Get(":id")
+		mCopy := copyResource(m)
+		if err := lockID(trans, mCopy, id); err != nil {
+			trans.Rollback()
+			return err
+		}
+		if err := authorize(r, mCopy); err != nil {
+			trans.Rollback()
+			return err
+		}
+		if err := checkIfMatch(r, mCopy); err != nil {
+			trans.Rollback()
+			return err
+		}
+		restorable, ok := mCopy.(Restorable)
+		if !ok {
+			trans.Rollback()
+			err := errors.New("resource can't be restored")
+			return httperr.New(http.StatusMethodNotAllowed, err.Error(), err)
+		}
+		before, err := model.Snapshot(mCopy)
+		if err != nil {
+			trans.Rollback()
+			return err
+		}
+
+		restorable.Restore()
+
+		if _, err := trans.Update(mCopy); err != nil {
+			trans.Rollback()
+			return err
+		}
+		if err := audit(trans, r, model.AuditActionRestore, mCopy, before, mCopy); err != nil {
+			trans.Rollback()
+			return err
+		}
+		if err := expand(trans, r, mCopy); err != nil {
+			trans.Rollback()
+			return err
+		}
+
+		if err := trans.Commit(); err != nil {
+			return err
+		}
+		setValidators(w, r, mCopy)
+		return json.NewEncoder(w).Encode(mCopy)
+	}
+}
+
+// includeDeleted returns true if r asks for soft deleted rows with
+// q-includeDeleted=true.  Only organizers may see them, so the request is
+// authenticated here when the route doesn't already require it.
+func includeDeleted(s gorp.SqlExecutor, w http.ResponseWriter, r *http.Request) (bool, error) {
+	if r.URL.Query().Get(KeyIncludeDeleted) != "true" {
+		return false, nil
+	}
+	member := CurrentMember(r)
+	if member == nil {
+		m, _, err := authenticate(s, w, r)
+		if err != nil {
+			return false, err
+		}
+		member = m
+	}
+	if !member.Organizer {
+		return false, errForbidden()
+	}
+	return true, nil
+}
+
+// isDeleted returns true if m has been soft deleted.
+func isDeleted(m CrudResource) bool {
+	v := reflect.ValueOf(m).Elem().FieldByName("Deleted")
+	return v.IsValid() && v.Kind() == reflect.Bool && v.Bool()
+}
@@ -0,0 +1,76 @@
+package mware
+
+import (
+	"net/http"
+
+	"github.com/SyntropyDev/httperr"
+	"github.com/bmizerany/pat"
+)
+
+// Router registers routes with pat and records them so the API can be
+// described by OpenAPI.
+type Router struct {
+	mux    *pat.PatternServeMux
+	routes []*Route
+}
+
+// Route is a method and pat pattern, along with the resource it reads or
+// writes if it's one of the crud handlers.
+type Route struct {
+	Method   string
+	Path     string
+	resource CrudResource
+}
+
+func NewRouter() *Router {
+	return &Router{mux: pat.New()}
+}
+
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rt.mux.ServeHTTP(w, r)
+}
+
+// Get registers h for GET requests, and like pat for HEAD requests too.
+func (rt *Router) Get(path string, h httperr.Handler) *Route {
+	rt.mux.Head(path, structuredErrors(h))
+	return rt.Add("GET", path, h)
+}
+
+func (rt *Router) Post(path string, h httperr.Handler) *Route {
+	return rt.Add("POST", path, h)
+}
+
+func (rt *Router) Put(path string, h httperr.Handler) *Route {
+	return rt.Add("PUT", path, h)
+}
+
+func (rt *Router) Del(path string, h httperr.Handler) *Route {
+	return rt.Add("DELETE", path, h)
+}
+
+// Add registers h for method requests.  Each request is given an id and
+// any error is written as an apiError.
+func (rt *Router) Add(method, path string, h httperr.Handler) *Route {
+	rt.mux.Add(method, path, structuredErrors(h))
+	route := &Route{Method: method, Path: path}
+	rt.routes = append(rt.routes, route)
+	return route
+}
+
+// Options registers a CORS preflight handler.  Preflights aren't part of
+// the API, so they aren't recorded.
+func (rt *Router) Options(path string, h http.Handler) {
+	rt.mux.Options(path, h)
+}
+
+// Routes returns the recorded routes in the order they were registered.
+func (rt *Router) Routes() []*Route {
+	return rt.routes
+}
+
+// Resource sets the resource the route reads or writes, which describes
+// its request and response bodies.
+func (r *Route) Resource(m CrudResource) *Route {
+	r.resource = m
+	return r
+}
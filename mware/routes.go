@@ -0,0 +1,97 @@
+package mware
+
+import (
+	"github.com/SyntropyDev/mms-api/model"
+)
+
+// APIRouter returns the router serving every route of the API under
+// prefix, like /api/v1.
+func APIRouter(prefix string) *Router {
+	m := NewRouter()
+
+	// no auth routes
+	m.Get(prefix+"/community", CommunityHandler())
+
+	m.Post(prefix+"/login", LoginHandler())
+	m.Post(prefix+"/login/2fa", TwoFactorLoginHandler())
+	m.Post(prefix+"/logout", LogoutHandler())
+	m.Post(prefix+"/signup", SignupHandler())
+	m.Post(prefix+"/reset-password", ResetPasswordHandler())
+	m.Post(prefix+"/reset-password/confirm", ConfirmResetPasswordHandler())
+	m.Post(prefix+"/request-invite", RequestInviteHandler())
+	m.Get(prefix+"/oauth/:provider/start", OAuthStartHandler())
+	m.Get(prefix+"/oauth/:provider/callback", OAuthCallbackHandler())
+
+	m.Get(prefix+"/members", ReadScope(model.ScopeMembersRead, GetAll(&model.Member{}))).Resource(&model.Member{})
+	m.Get(prefix+"/members/:id", ReadScope(model.ScopeMembersRead, GetByID(&model.Member{}))).Resource(&model.Member{})
+
+	m.Get(prefix+"/feeds", ReadScope(model.ScopeFeedsRead, GetAll(&model.Feed{}))).Resource(&model.Feed{})
+	m.Get(prefix+"/feeds/:id", ReadScope(model.ScopeFeedsRead, GetByID(&model.Feed{}))).Resource(&model.Feed{})
+
+	m.Get(prefix+"/categories", ReadScope(model.ScopeCategoriesRead, GetAll(&model.Category{}))).Resource(&model.Category{})
+	m.Get(prefix+"/categories/:id", ReadScope(model.ScopeCategoriesRead, GetByID(&model.Category{}))).Resource(&model.Category{})
+
+	m.Get(prefix+"/top-stories", ReadScope(model.ScopeStoriesRead, TopStoriesHandler()))
+	m.Get(prefix+"/search", ReadScope(model.ScopeStoriesRead, ReadScope(model.ScopeMembersRead, SearchHandler())))
+	m.Get(prefix+"/stories", ReadScope(model.ScopeStoriesRead, GetAll(&model.Story{}))).Resource(&model.Story{})
+	m.Get(prefix+"/stories/:id", ReadScope(model.ScopeStoriesRead, GetByID(&model.Story{}))).Resource(&model.Story{})
+
+	// auth routes
+	m.Post(prefix+"/invite", Auth(Organizer(InviteHandler())))
+	m.Post(prefix+"/change-password", Auth(ChangePasswordHandler()))
+	m.Post(prefix+"/token/refresh", Auth(RefreshTokenHandler()))
+	m.Post(prefix+"/logout-all", Auth(LogoutAllHandler()))
+	m.Get(prefix+"/sessions", Auth(SessionsHandler()))
+	m.Del(prefix+"/sessions/:id", Auth(DeleteSessionHandler()))
+	m.Post(prefix+"/two-factor/enroll", Auth(EnrollTwoFactorHandler()))
+	m.Post(prefix+"/two-factor/confirm", Auth(ConfirmTwoFactorHandler()))
+	m.Post(prefix+"/two-factor/disable", Auth(DisableTwoFactorHandler()))
+
+	m.Put(prefix+"/communities/:id", Auth(UpdateByID(&model.Community{}))).Resource(&model.Community{})
+	m.Add("PATCH", prefix+"/communities/:id", Auth(PatchByID(&model.Community{}))).Resource(&model.Community{})
+
+	m.Get(prefix+"/registrations", Auth(Organizer(GetAll(&model.Registration{})))).Resource(&model.Registration{})
+	m.Get(prefix+"/registrations/:id", Auth(Organizer(GetByID(&model.Registration{})))).Resource(&model.Registration{})
+	m.Post(prefix+"/registrations/:id/approve", Auth(Organizer(ApproveRegistrationHandler())))
+	m.Post(prefix+"/registrations/:id/reject", Auth(Organizer(RejectRegistrationHandler())))
+
+	m.Post(prefix+"/import/members", Auth(Organizer(ImportMembersHandler())))
+	m.Post(prefix+"/members", AuthScope(model.ScopeMembersWrite, Create(&model.Member{}))).Resource(&model.Member{})
+	m.Post(prefix+"/members/batch", AuthScope(model.ScopeMembersWrite, Batch(&model.Member{})))
+	m.Post(prefix+"/members/:id/unlock", Auth(Organizer(UnlockMemberHandler())))
+	m.Put(prefix+"/members/:id", AuthScope(model.ScopeMembersWrite, UpdateByID(&model.Member{}))).Resource(&model.Member{})
+	m.Add("PATCH", prefix+"/members/:id", AuthScope(model.ScopeMembersWrite, PatchByID(&model.Member{}))).Resource(&model.Member{})
+	m.Del(prefix+"/members/:id", AuthScope(model.ScopeMembersWrite, DeleteByID(&model.Member{}))).Resource(&model.Member{})
+	m.Post(prefix+"/members/:id/restore", AuthScope(model.ScopeMembersWrite, RestoreByID(&model.Member{}))).Resource(&model.Member{})
+
+	m.Post(prefix+"/feeds", AuthScope(model.ScopeFeedsWrite, Create(&model.Feed{}))).Resource(&model.Feed{})
+	m.Post(prefix+"/feeds/batch", AuthScope(model.ScopeFeedsWrite, Batch(&model.Feed{})))
+	m.Put(prefix+"/feeds/:id", AuthScope(model.ScopeFeedsWrite, UpdateByID(&model.Feed{}))).Resource(&model.Feed{})
+	m.Add("PATCH", prefix+"/feeds/:id", AuthScope(model.ScopeFeedsWrite, PatchByID(&model.Feed{}))).Resource(&model.Feed{})
+	m.Del(prefix+"/feeds/:id", AuthScope(model.ScopeFeedsWrite, DeleteByID(&model.Feed{}))).Resource(&model.Feed{})
+	m.Post(prefix+"/feeds/:id/restore", AuthScope(model.ScopeFeedsWrite, RestoreByID(&model.Feed{}))).Resource(&model.Feed{})
+
+	m.Post(prefix+"/categories", AuthScope(model.ScopeCategoriesWrite, Create(&model.Category{}))).Resource(&model.Category{})
+	m.Post(prefix+"/categories/batch", AuthScope(model.ScopeCategoriesWrite, Batch(&model.Category{})))
+	m.Put(prefix+"/categories/:id", AuthScope(model.ScopeCategoriesWrite, UpdateByID(&model.Category{}))).Resource(&model.Category{})
+	m.Add("PATCH", prefix+"/categories/:id", AuthScope(model.ScopeCategoriesWrite, PatchByID(&model.Category{}))).Resource(&model.Category{})
+	m.Del(prefix+"/categories/:id", AuthScope(model.ScopeCategoriesWrite, DeleteByID(&model.Category{}))).Resource(&model.Category{})
+	m.Post(prefix+"/categories/:id/restore", AuthScope(model.ScopeCategoriesWrite, RestoreByID(&model.Category{}))).Resource(&model.Category{})
+
+	m.Del(prefix+"/stories/:id", AuthScope(model.ScopeStoriesWrite, DeleteByID(&model.Story{}))).Resource(&model.Story{})
+	m.Post(prefix+"/stories/:id/restore", AuthScope(model.ScopeStoriesWrite, RestoreByID(&model.Story{}))).Resource(&model.Story{})
+
+	m.Post(prefix+"/api-keys", Auth(Organizer(CreateAPIKeyHandler())))
+	m.Get(prefix+"/api-keys", Auth(Organizer(GetAll(&model.APIKey{})))).Resource(&model.APIKey{})
+	m.Del(prefix+"/api-keys/:id", Auth(Organizer(DeleteByID(&model.APIKey{})))).Resource(&model.APIKey{})
+
+	m.Get(prefix+"/audit", Auth(Organizer(GetAll(&model.AuditEvent{})))).Resource(&model.AuditEvent{})
+
+	m.Get(prefix+"/openapi.json", OpenAPIHandler(m))
+
+	// cors
+	m.Options(prefix+"/:any", PreflightHandler())
+	m.Options(prefix+"/:any1/:any2", PreflightHandler())
+	m.Options(prefix+"/:any1/:any2/:any3", PreflightHandler())
+	return m
+}
@@ -0,0 +1,41 @@
+package mware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/SyntropyDev/mms-api/model"
+)
+
+func TestEveryRouteHasPreflight(t *testing.T) {
+	rt := APIRouter(testPrefix)
+	for _, route := range rt.Routes() {
+		parts := strings.Split(route.Path, "/")
+		for i, part := range parts {
+			if strings.HasPrefix(part, ":") {
+				parts[i] = "1"
+			}
+		}
+		path := strings.Join(parts, "/")
+
+		r, err := http.NewRequest("OPTIONS", path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, r)
+		if !strings.Contains(w.HeaderMap.Get("Access-Control-Allow-Headers"), "Authorization") {
+			t.Errorf("OPTIONS %s got %d without the preflight headers", path, w.Code)
+		}
+	}
+}
+
+func TestDeletedIsNotMergeable(t *testing.T) {
+	for _, m := range []CrudResource{&model.Member{}, &model.Feed{}, &model.Category{}, &model.Story{}} {
+		if _, ok := patchFields(m)["deleted"]; ok {
+			t.Errorf("%s can be deleted by an update", m.TableName())
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package mware
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/SyntropyDev/httperr"
+	"github.com/SyntropyDev/mms-api/model"
+)
+
+const (
+	searchMaxLimit = 100
+)
+
+var (
+	searcher model.Searcher = model.MySQLSearcher{}
+)
+
+// SetSearcher sets the backend used by SearchHandler.  It defaults to
+// MySQL's FULLTEXT indexes.
+func SetSearcher(s model.Searcher) {
+	searcher = s
+}
+
+// SearchHandler returns the stories and members best matching the q query
+// parameter.  categoryId, feedType, from and to narrow the results, q-limit
+// caps each list at up to 100, and q-expand embeds the stories' relations
+// as it does for GetAll.
+func SearchHandler() httperr.Handler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		v := r.URL.Query()
+
+		q := &model.SearchQuery{
+			Text:     v.Get("q"),
+			FeedType: v.Get("feedType"),
+			Limit:    uintFromKey(v, KeyLimit, 20),
+		}
+		if q.Limit > searchMaxLimit {
+			q.Limit = searchMaxLimit
+		}
+		if q.Text == "" {
+			err := errors.New("q is required")
+			return httperr.New(http.StatusBadRequest, err.Error(), err)
+		}
+		switch model.FeedType(q.FeedType) {
+		case "", model.FeedTypeTwitter, model.FeedTypeFacebook, model.FeedTypeRSS:
+		default:
+			err := errors.New("feedType must be twitter, facebook or rss")
+			return httperr.New(http.StatusBadRequest, err.Error(), err)
+		}
+		for key, dest := range map[string]*int64{"categoryId": &q.CategoryID, "from": &q.From, "to": &q.To} {
+			if s := v.Get(key); s != "" {
+				i, err := strconv.ParseInt(s, 10, 64)
+				if err != nil {
+					return httperr.New(http.StatusBadRequest, key+" must be a number", err)
+				}
+				*dest = i
+			}
+		}
+
+		dbmap, err := getDB()
+		defer dbmap.Db.Close()
+		if err != nil {
+			return err
+		}
+
+		results, err := searcher.Search(dbmap, q)
+		if err != nil {
+			return err
+		}
+
+		stories := make([]interface{}, len(results.Stories))
+		for i, story := range results.Stories {
+			stories[i] = story
+		}
+		if err := model.Expand(dbmap, stories, expandRelations(v)); err != nil {
+			return err
+		}
+
+		return json.NewEncoder(w).Encode(results)
+	}
+}
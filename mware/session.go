@@ -0,0 +1,84 @@
+package mware
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/SyntropyDev/httperr"
+	"github.com/SyntropyDev/mms-api/model"
+)
+
+// SessionsHandler lists the devices the authenticated member is logged in
+// on.  It must be wrapped by Auth.
+func SessionsHandler() httperr.Handler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		dbmap, err := getDB()
+		defer dbmap.Db.Close()
+		if err != nil {
+			return err
+		}
+
+		member := CurrentMember(r)
+		current := currentToken(r)
+		if member == nil || current == nil {
+			return errNotAuthorized()
+		}
+
+		tokens, err := model.MemberTokens(dbmap, member.ID)
+		if err != nil {
+			return err
+		}
+		for _, t := range tokens {
+			t.Current = t.ID == current.ID
+		}
+		return json.NewEncoder(w).Encode(tokens)
+	}
+}
+
+// DeleteSessionHandler logs the authenticated member out of one of their
+// sessions.  It must be wrapped by Auth.
+func DeleteSessionHandler() httperr.Handler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		dbmap, err := getDB()
+		defer dbmap.Db.Close()
+		if err != nil {
+			return err
+		}
+
+		member := CurrentMember(r)
+		if member == nil {
+			return errNotAuthorized()
+		}
+
+		id, _ := strconv.ParseInt(r.URL.Query().Get(":id"), 10, 64)
+		tokens, err := model.MemberTokens(dbmap, member.ID)
+		if err != nil {
+			return err
+		}
+		for _, t := range tokens {
+			if t.ID == id {
+				trans, err := dbmap.Begin()
+				if err != nil {
+					return err
+				}
+				if _, err := trans.Delete(t); err != nil {
+					trans.Rollback()
+					return err
+				}
+				if err := audit(trans, r, model.AuditActionRevoke, t, t, nil); err != nil {
+					trans.Rollback()
+					return err
+				}
+				if err := trans.Commit(); err != nil {
+					return err
+				}
+				return json.NewEncoder(w).Encode(t)
+			}
+		}
+
+		err = errors.New("Could not find session.")
+		return httperr.New(http.StatusNotFound, err.Error(), err)
+	}
+}
@@ -0,0 +1,125 @@
+package mware
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SyntropyDev/mms-api/model"
+)
+
+const (
+	// trustProxyEnv names the config switch that takes client IPs from the
+	// X-Forwarded-For header set by a load balancer.
+	trustProxyEnv = "trustProxy"
+
+	// trustedProxyHopsEnv names the config value with how many proxies in
+	// front of the API each append to X-Forwarded-For.  Entries left of
+	// theirs were sent by the client and can't be trusted.
+	trustedProxyHopsEnv     = "trustedProxyHops"
+	defaultTrustedProxyHops = 1
+
+	// many members may share an address, so it takes more failures to
+	// slow down an IP than an account
+	ipBackoffThresholdEnv = "loginIPBackoffThreshold"
+
+	ipAttemptTTL = time.Hour
+)
+
+// ipAttempts counts failed logins from a single client IP.
+type ipAttempts struct {
+	failures int
+	last     time.Time
+}
+
+var (
+	ipAttemptsMu sync.Mutex
+	ipFailures   = map[string]*ipAttempts{}
+)
+
+// checkIPLogin returns a LoginDelayError if ip must wait before trying to
+// log in again.
+func checkIPLogin(ip string) error {
+	ipAttemptsMu.Lock()
+	defer ipAttemptsMu.Unlock()
+
+	a, ok := ipFailures[ip]
+	if !ok {
+		return nil
+	}
+	backoff := model.Backoff(a.failures, model.ConfigInt(ipBackoffThresholdEnv, 10))
+	retry := a.last.Add(backoff)
+	if now := time.Now(); now.Before(retry) {
+		return &model.LoginDelayError{
+			Code:       http.StatusTooManyRequests,
+			M:          "too many failed logins, try again later",
+			Err:        "too many failed logins from " + ip,
+			RetryAfter: retry.Sub(now),
+		}
+	}
+	return nil
+}
+
+// recordIPLogin tracks the outcome of a login attempt from ip.
+func recordIPLogin(ip string, success bool) {
+	ipAttemptsMu.Lock()
+	defer ipAttemptsMu.Unlock()
+
+	now := time.Now()
+	for k, a := range ipFailures {
+		if now.Sub(a.last) > ipAttemptTTL {
+			delete(ipFailures, k)
+		}
+	}
+
+	if success {
+		delete(ipFailures, ip)
+		return
+	}
+	a, ok := ipFailures[ip]
+	if !ok {
+		a = &ipAttempts{}
+		ipFailures[ip] = a
+	}
+	a.failures++
+	a.last = now
+}
+
+// withRetryAfter tells the client when to retry if err is a
+// LoginDelayError.
+func withRetryAfter(w http.ResponseWriter, err error) error {
+	if e, ok := err.(*model.LoginDelayError); ok {
+		secs := int(math.Ceil(e.RetryAfter.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(secs))
+	}
+	return err
+}
+
+// clientIP returns the address of the client that sent r.  Behind trusted
+// proxies it's the X-Forwarded-For entry added by the outermost of them.
+func clientIP(r *http.Request) string {
+	if os.Getenv(trustProxyEnv) == "true" {
+		if fwd := r.Header["X-Forwarded-For"]; len(fwd) > 0 {
+			entries := strings.Split(strings.Join(fwd, ","), ",")
+			hops := model.ConfigInt(trustedProxyHopsEnv, defaultTrustedProxyHops)
+			if hops < 1 {
+				hops = 1
+			}
+			i := len(entries) - hops
+			if i < 0 {
+				i = 0
+			}
+			return strings.TrimSpace(entries[i])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,362 @@
+package mware
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/SyntropyDev/httperr"
+	"github.com/SyntropyDev/mms-api/model"
+	"github.com/coopernurse/gorp"
+	"github.com/dchest/uniuri"
+)
+
+const (
+	loginChallengeTTL         = 5 * time.Minute
+	loginChallengeMaxAttempts = 5
+)
+
+// loginChallenge is issued in place of a token to members who must pass two
+// factor authentication.
+type loginChallenge struct {
+	memberID int64
+	// secret is set when the member must enroll to finish logging in
+	secret   string
+	attempts int
+	expires  time.Time
+}
+
+var (
+	loginChallengesMu sync.Mutex
+	loginChallenges   = map[string]*loginChallenge{}
+)
+
+// startSession responds with a new token for member, or with a two factor
+// challenge if the member must pass one first.
+func startSession(w http.ResponseWriter, r *http.Request, s gorp.SqlExecutor, member *model.Member) error {
+	community, err := model.FindCommunity(s)
+	if err != nil {
+		community = nil
+	}
+
+	if !member.TwoFactorRequired(community) {
+		token, err := newToken(s, r, member)
+		if err != nil {
+			return err
+		}
+		member.Token = token.Value
+		return json.NewEncoder(w).Encode(member)
+	}
+
+	type challengeResp struct {
+		Challenge         string `json:"challenge"`
+		TwoFactorRequired bool   `json:"twoFactorRequired"`
+		Enroll            bool   `json:"enroll"`
+		Secret            string `json:"secret,omitempty"`
+		ProvisioningURI   string `json:"provisioningUri,omitempty"`
+	}
+
+	c := &loginChallenge{
+		memberID: member.ID,
+		expires:  time.Now().Add(loginChallengeTTL),
+	}
+	resp := &challengeResp{
+		Challenge:         uniuri.NewLen(32),
+		TwoFactorRequired: true,
+	}
+	if !member.TOTPEnabled {
+		c.secret = model.NewTOTPSecret()
+		resp.Enroll = true
+		resp.Secret = c.secret
+		resp.ProvisioningURI = model.TOTPProvisioningURI(c.secret, member.Email)
+	}
+	putLoginChallenge(resp.Challenge, c)
+	return json.NewEncoder(w).Encode(resp)
+}
+
+// TwoFactorLoginHandler finishes logging in with the challenge from
+// LoginHandler and a code from the member's authenticator app or one of
+// their recovery codes.  Members enrolling as part of the login get their
+// recovery codes in the response.
+func TwoFactorLoginHandler() httperr.Handler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+
+		type twoFactorLoginReq struct {
+			Challenge string
+			Code      string
+		}
+
+		req := &twoFactorLoginReq{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			return httperr.New(http.StatusBadRequest, err.Error(), err)
+		}
+
+		dbmap, err := getDB()
+		defer dbmap.Db.Close()
+		if err != nil {
+			return err
+		}
+
+		c, err := getLoginChallenge(req.Challenge)
+		if err != nil {
+			return err
+		}
+		member := &model.Member{}
+		if err := GetID(dbmap, member, c.memberID); err != nil {
+			return err
+		}
+		if err := member.CheckLoginAllowed(); err != nil {
+			return err
+		}
+
+		before, err := model.Snapshot(member)
+		if err != nil {
+			return err
+		}
+		ok := false
+		if c.secret != "" {
+			ok, err = member.ConfirmTOTPEnrollment(dbmap, c.secret, req.Code)
+		} else {
+			ok, err = member.CheckTwoFactor(dbmap, req.Code)
+		}
+		if err != nil {
+			return err
+		}
+		if !ok {
+			failLoginChallenge(req.Challenge)
+			if err := member.RecordFailedLogin(dbmap); err != nil {
+				return err
+			}
+			return errTwoFactorInvalid()
+		}
+		deleteLoginChallenge(req.Challenge)
+		if err := member.ResetFailedLogins(dbmap); err != nil {
+			return err
+		}
+		if c.secret != "" {
+			// the member isn't authenticated yet, so name them as the actor
+			setContext(r, &requestContext{member: member})
+			defer clearContext(r)
+			if err := audit(dbmap, r, model.AuditActionEnableTOTP, member, before, member); err != nil {
+				return err
+			}
+		}
+
+		token, err := newToken(dbmap, r, member)
+		if err != nil {
+			return err
+		}
+		member.Token = token.Value
+		return json.NewEncoder(w).Encode(member)
+	}
+}
+
+// EnrollTwoFactorHandler gives the authenticated member a new TOTP secret
+// to add to their authenticator app.  It isn't used until confirmed.  It
+// must be wrapped by Auth.
+func EnrollTwoFactorHandler() httperr.Handler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		dbmap, err := getDB()
+		defer dbmap.Db.Close()
+		if err != nil {
+			return err
+		}
+
+		member := CurrentMember(r)
+		if member == nil {
+			return errNotAuthorized()
+		}
+		if member.TOTPEnabled {
+			err := errors.New("two factor authentication already enabled")
+			return httperr.New(http.StatusBadRequest, err.Error(), err)
+		}
+		if err := member.StartTOTPEnrollment(dbmap); err != nil {
+			return err
+		}
+
+		return json.NewEncoder(w).Encode(map[string]string{
+			"secret":          member.TOTPSecret,
+			"provisioningUri": model.TOTPProvisioningURI(member.TOTPSecret, member.Email),
+		})
+	}
+}
+
+// ConfirmTwoFactorHandler turns on two factor authentication once the
+// member proves their authenticator app works, and responds with their
+// recovery codes.  It must be wrapped by Auth.
+func ConfirmTwoFactorHandler() httperr.Handler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+
+		type confirmTwoFactorReq struct {
+			Code string
+		}
+
+		req := &confirmTwoFactorReq{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			return httperr.New(http.StatusBadRequest, err.Error(), err)
+		}
+
+		dbmap, err := getDB()
+		defer dbmap.Db.Close()
+		if err != nil {
+			return err
+		}
+
+		member := CurrentMember(r)
+		if member == nil {
+			return errNotAuthorized()
+		}
+		if member.TOTPEnabled {
+			err := errors.New("two factor authentication already enabled")
+			return httperr.New(http.StatusBadRequest, err.Error(), err)
+		}
+		before, err := model.Snapshot(member)
+		if err != nil {
+			return err
+		}
+
+		trans, err := dbmap.Begin()
+		if err != nil {
+			return err
+		}
+		ok, err := member.ConfirmTOTPEnrollment(trans, member.TOTPSecret, req.Code)
+		if err != nil {
+			trans.Rollback()
+			return err
+		}
+		if !ok {
+			trans.Rollback()
+			err := errors.New("two factor code invalid")
+			return httperr.New(http.StatusBadRequest, err.Error(), err)
+		}
+		if err := audit(trans, r, model.AuditActionEnableTOTP, member, before, member); err != nil {
+			trans.Rollback()
+			return err
+		}
+		if err := trans.Commit(); err != nil {
+			return err
+		}
+		return json.NewEncoder(w).Encode(member)
+	}
+}
+
+// DisableTwoFactorHandler turns off two factor authentication, unless the
+// community requires it of the organizer asking.  It must be wrapped by
+// Auth.
+func DisableTwoFactorHandler() httperr.Handler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+
+		type disableTwoFactorReq struct {
+			Code string
+		}
+
+		req := &disableTwoFactorReq{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			return httperr.New(http.StatusBadRequest, err.Error(), err)
+		}
+
+		dbmap, err := getDB()
+		defer dbmap.Db.Close()
+		if err != nil {
+			return err
+		}
+
+		member := CurrentMember(r)
+		if member == nil {
+			return errNotAuthorized()
+		}
+		if community, err := model.FindCommunity(dbmap); err == nil &&
+			member.Organizer && community.RequireOrganizerTwoFactor {
+			return errForbidden()
+		}
+		if err := member.CheckLoginAllowed(); err != nil {
+			return err
+		}
+		before, err := model.Snapshot(member)
+		if err != nil {
+			return err
+		}
+
+		trans, err := dbmap.Begin()
+		if err != nil {
+			return err
+		}
+		ok, err := member.CheckTwoFactor(trans, req.Code)
+		if err != nil {
+			trans.Rollback()
+			return err
+		}
+		if !ok {
+			trans.Rollback()
+			if err := member.RecordFailedLogin(dbmap); err != nil {
+				return err
+			}
+			return errTwoFactorInvalid()
+		}
+		if err := member.DisableTOTP(trans); err != nil {
+			trans.Rollback()
+			return err
+		}
+		if err := audit(trans, r, model.AuditActionDisableTOTP, member, before, member); err != nil {
+			trans.Rollback()
+			return err
+		}
+		if err := trans.Commit(); err != nil {
+			return err
+		}
+		return json.NewEncoder(w).Encode(member)
+	}
+}
+
+func putLoginChallenge(key string, c *loginChallenge) {
+	loginChallengesMu.Lock()
+	defer loginChallengesMu.Unlock()
+
+	now := time.Now()
+	for k, other := range loginChallenges {
+		if now.After(other.expires) {
+			delete(loginChallenges, k)
+		}
+	}
+	loginChallenges[key] = c
+}
+
+func getLoginChallenge(key string) (*loginChallenge, error) {
+	loginChallengesMu.Lock()
+	defer loginChallengesMu.Unlock()
+
+	c, ok := loginChallenges[key]
+	if !ok || time.Now().After(c.expires) {
+		delete(loginChallenges, key)
+		err := errors.New("login challenge expired, please log in again")
+		return nil, httperr.New(http.StatusUnauthorized, err.Error(), err)
+	}
+	return c, nil
+}
+
+// failLoginChallenge counts a wrong code against the challenge and forgets
+// it after too many.
+func failLoginChallenge(key string) {
+	loginChallengesMu.Lock()
+	defer loginChallengesMu.Unlock()
+
+	if c, ok := loginChallenges[key]; ok {
+		c.attempts++
+		if c.attempts >= loginChallengeMaxAttempts {
+			delete(loginChallenges, key)
+		}
+	}
+}
+
+func deleteLoginChallenge(key string) {
+	loginChallengesMu.Lock()
+	defer loginChallengesMu.Unlock()
+	delete(loginChallenges, key)
+}
+
+func errTwoFactorInvalid() error {
+	err := errors.New("two factor code invalid")
+	return httperr.New(http.StatusUnauthorized, err.Error(), err)
+}
@@ -12,9 +12,8 @@ import (
 
 	"github.com/SyntropyDev/mms-api/model"
 	"github.com/SyntropyDev/mms-api/mware"
-	"github.com/bmizerany/pat"
 	"github.com/coopernurse/gorp"
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 )
 
 const (
@@ -23,58 +22,43 @@ const (
 
 func main() {
 	initConfig()
-	initSQL()
+	if err := model.CheckTokenSecret(); err != nil {
+		log.Fatal("Error: ", err)
+	}
+	if err := model.LoadPasswordWordlist(); err != nil {
+		log.Fatal("Error: ", err)
+	}
+	if err := model.CheckBcryptCost(); err != nil {
+		log.Fatal("Error: ", err)
+	}
+	if err := initSQL(); err != nil {
+		log.Println("Error: ", err)
+	}
+	// tokens can't be saved or found until they're migrated
+	if err := run(model.MigrateTokenHashes); err != nil {
+		log.Fatal("Error: ", err)
+	}
 
 	mware.SetGetDBConnectionFunc(db)
 
-	m := pat.New()
-
-	// no auth routes
-	m.Get(prefix+"/community", mware.CommunityHandler())
-
-	m.Post(prefix+"/login", mware.LoginHandler())
-	m.Post(prefix+"/logout", mware.LogoutHandler())
-	m.Post(prefix+"/signup", mware.SignupHandler())
-	m.Post(prefix+"/reset-password", mware.ResetPasswordHandler())
-	// m.Post(prefix+"/request-invite", mware.RequestInviteHandler())
-
-	m.Get(prefix+"/members", mware.GetAll(&model.Member{}))
-	m.Get(prefix+"/members/:id", mware.GetByID(&model.Member{}))
-
-	m.Get(prefix+"/feeds", mware.GetAll(&model.Feed{}))
-	m.Get(prefix+"/feeds/:id", mware.GetByID(&model.Feed{}))
-
-	m.Get(prefix+"/categories", mware.GetAll(&model.Category{}))
-	m.Get(prefix+"/categories/:id", mware.GetByID(&model.Category{}))
-
-	m.Get(prefix+"/top-stories", mware.TopStoriesHandler())
-	m.Get(prefix+"/stories", mware.GetAll(&model.Story{}))
-	m.Get(prefix+"/stories/:id", mware.GetByID(&model.Story{}))
-
-	// auth routes
-	m.Post(prefix+"/invite", mware.Auth(mware.InviteHandler()))
-	m.Post(prefix+"/change-password", mware.Auth(mware.ChangePasswordHandler()))
-
-	m.Post(prefix+"/members", mware.Auth(mware.Create(&model.Member{})))
-	m.Put(prefix+"/members/:id", mware.Auth(mware.UpdateByID(&model.Member{})))
-	m.Del(prefix+"/members/:id", mware.Auth(mware.DeleteByID(&model.Member{})))
-
-	m.Post(prefix+"/feeds", mware.Auth(mware.Create(&model.Feed{})))
-	m.Put(prefix+"/feeds/:id", mware.Auth(mware.UpdateByID(&model.Feed{})))
-	m.Del(prefix+"/feeds/:id", mware.Auth(mware.DeleteByID(&model.Feed{})))
-
-	m.Post(prefix+"/categories", mware.Auth(mware.Create(&model.Category{})))
-	m.Put(prefix+"/categories/:id", mware.Auth(mware.UpdateByID(&model.Category{})))
-	m.Del(prefix+"/categories/:id", mware.Auth(mware.DeleteByID(&model.Category{})))
-
-	m.Del(prefix+"/stories/:id", mware.Auth(mware.DeleteByID(&model.Story{})))
-
-	// cors
-	m.Options(prefix+"/:any", mware.CommunityHandler())
-	m.Options(prefix+"/:any1/:any2", mware.CommunityHandler())
+	m := mware.APIRouter(prefix)
+	if err := m.CheckOpenAPI(); err != nil {
+		log.Fatal("Error: ", err)
+	}
 
 	go runInBackground(time.Minute*10, model.ListenToFeeds)
 	go runInBackground(time.Minute*5, model.DecayScores)
+	go runInBackground(time.Hour, model.PurgeExpiredTokens)
+	go runInBackground(time.Minute, model.FlushTokenUsage)
+	go runInBackground(time.Hour, model.PurgeExpiredPasswordResets)
+	go runInBackground(time.Hour*24, model.PurgeDeleted)
+
+	// small deployments without FULLTEXT support can search in memory
+	if os.Getenv("searchBackend") == "memory" {
+		index := model.NewMemoryIndex()
+		mware.SetSearcher(index)
+		go runInBackground(time.Minute*5, index.Rebuild)
+	}
 
 	http.Handle("/", m)
 	log.Println("Listening...")
@@ -85,22 +69,23 @@ func main() {
 
 func runInBackground(d time.Duration, f func(s gorp.SqlExecutor) error) {
 	for {
-		err := func() error {
-			dbmap, err := db()
-			if err != nil {
-				return err
-			}
-			defer dbmap.Db.Close()
-
-			return f(dbmap)
-		}()
-		if err != nil {
+		if err := run(f); err != nil {
 			fmt.Println("Error: ", err)
 		}
 		time.Sleep(d)
 	}
 }
 
+func run(f func(s gorp.SqlExecutor) error) error {
+	dbmap, err := db()
+	if err != nil {
+		return err
+	}
+	defer dbmap.Db.Close()
+
+	return f(dbmap)
+}
+
 func initConfig() error {
 	b, err := ioutil.ReadFile("./config.json")
 	if err != nil {
@@ -138,6 +123,11 @@ func db() (*gorp.DbMap, error) {
 	dbmap.AddTableWithName(model.Community{}, model.TableNameCommunity).SetKeys(true, "ID")
 	dbmap.AddTableWithName(model.Token{}, model.TableNameToken).SetKeys(true, "ID")
 	dbmap.AddTableWithName(model.CategoryMember{}, model.TableNameCategoryMember)
+	dbmap.AddTableWithName(model.PasswordReset{}, model.TableNamePasswordReset).SetKeys(true, "ID")
+	dbmap.AddTableWithName(model.Registration{}, model.TableNameRegistration).SetKeys(true, "ID")
+	dbmap.AddTableWithName(model.Identity{}, model.TableNameIdentity).SetKeys(true, "ID")
+	dbmap.AddTableWithName(model.APIKey{}, model.TableNameAPIKey).SetKeys(true, "ID")
+	dbmap.AddTableWithName(model.AuditEvent{}, model.TableNameAuditEvent).SetKeys(true, "ID")
 
 	return dbmap, nil
 }
@@ -147,6 +137,8 @@ func initSQL() error {
 	if err != nil {
 		return err
 	}
+	defer db.Close()
+
 	if _, err := db.Exec(sqlCreateCommunity); err != nil {
 		return err
 	}
@@ -168,12 +160,41 @@ func initSQL() error {
 	if _, err := db.Exec(sqlCreateCategoryMembers); err != nil {
 		return err
 	}
+	if _, err := db.Exec(sqlCreatePasswordResets); err != nil {
+		return err
+	}
+	if _, err := db.Exec(sqlCreateRegistrations); err != nil {
+		return err
+	}
+	if _, err := db.Exec(sqlCreateIdentities); err != nil {
+		return err
+	}
+	if _, err := db.Exec(sqlCreateAPIKeys); err != nil {
+		return err
+	}
+	if _, err := db.Exec(sqlCreateAuditEvents); err != nil {
+		return err
+	}
+
+	// bring tables created by older versions up to date
+	for _, migration := range sqlMigrations {
+		if _, err := db.Exec(migration); err != nil && !isAlreadyMigrated(err) {
+			return err
+		}
+	}
 	return nil
 }
 
+// isAlreadyMigrated returns true if err says a migration's column or index
+// already exists.
+func isAlreadyMigrated(err error) bool {
+	mErr, ok := err.(*mysql.MySQLError)
+	return ok && (mErr.Number == 1060 || mErr.Number == 1061)
+}
+
 const (
 	sqlCreateCommunity = `
-	CREATE TABLE communities(
+	CREATE TABLE IF NOT EXISTS communities(
 		ID bigint(20) NOT NULL AUTO_INCREMENT,
 		Created bigint(20) NOT NULL,
 		Updated bigint(20) NOT NULL,
@@ -183,11 +204,13 @@ const (
 		Latitude double Not Null,
 		Longitude double Not Null,
 		Description text Not Null,
+		RegistrationPolicy varchar(255) NOT Null DEFAULT 'closed',
+		RequireOrganizerTwoFactor tinyint(1) NOT NULL DEFAULT 0,
 		PRIMARY KEY (ID)
 	);`
 
 	sqlCreateMembers = `
-	CREATE TABLE members(
+	CREATE TABLE IF NOT EXISTS members(
 		ID bigint(20) NOT NULL AUTO_INCREMENT,
 		Created bigint(20) NOT NULL,
 		Updated bigint(20) NOT NULL,
@@ -208,12 +231,22 @@ const (
 		ImagesRaw text Not Null,
 		HashtagsRaw text Not Null,
 
+		FailedLogins bigint(20) NOT NULL DEFAULT 0,
+		LastFailedLogin bigint(20) NOT NULL DEFAULT 0,
+		LockedUntil bigint(20) NOT NULL DEFAULT 0,
+
+		TOTPSecret varchar(255) NOT Null DEFAULT '',
+		TOTPEnabled tinyint(1) NOT NULL DEFAULT 0,
+		TOTPLastStep bigint(20) NOT NULL DEFAULT 0,
+		RecoveryCodesRaw text NOT Null,
+
 		PRIMARY KEY (ID),
-		UNIQUE (Email)
+		UNIQUE (Email),
+		FULLTEXT KEY ftNameDescription (Name, Description)
 	);`
 
 	sqlCreateCategories = `
-	CREATE TABLE categories(
+	CREATE TABLE IF NOT EXISTS categories(
 		ID bigint(20) NOT NULL AUTO_INCREMENT,
 		Created bigint(20) NOT NULL,
 		Updated bigint(20) NOT NULL,
@@ -225,7 +258,7 @@ const (
 	);`
 
 	sqlCreateFeeds = `
-	CREATE TABLE feeds(
+	CREATE TABLE IF NOT EXISTS feeds(
 		ID bigint(20) NOT NULL AUTO_INCREMENT,
 		Created bigint(20) NOT NULL,
 		Updated bigint(20) NOT NULL,
@@ -242,7 +275,7 @@ const (
 	);`
 
 	sqlCreateStories = `
-	CREATE TABLE stories(
+	CREATE TABLE IF NOT EXISTS stories(
 		ID bigint(20) NOT NULL AUTO_INCREMENT,
 		Created bigint(20) NOT NULL,
 		Updated bigint(20) NOT NULL,
@@ -269,30 +302,146 @@ const (
 		FOREIGN KEY (MemberID) REFERENCES members(ID),
 		FOREIGN KEY (FeedID) REFERENCES feeds(ID),
 		UNIQUE (Timestamp),
-		UNIQUE (SourceID)
+		UNIQUE (SourceID),
+		FULLTEXT KEY ftBody (Body)
 	);`
 
 	sqlCreateTokens = `
-	CREATE TABLE tokens(
+	CREATE TABLE IF NOT EXISTS tokens(
 		ID bigint(20) NOT NULL AUTO_INCREMENT,
 		Created bigint(20) NOT NULL,
 		Updated bigint(20) NOT NULL,
 		Deleted tinyint(1) NOT NULL,
 		
 		MemberID bigint(20) NOT Null,
-		Value varchar(255) NOT Null,
+		Hash varchar(255) NOT Null,
 		Expiration bigint(20) NOT NULL,
+		UserAgent varchar(255) NOT Null DEFAULT '',
+		IP varchar(255) NOT Null DEFAULT '',
+		LastUsed bigint(20) NOT NULL DEFAULT 0,
 
 		PRIMARY KEY (ID),
+		INDEX (Hash),
 		FOREIGN KEY (MemberID) REFERENCES members(ID)
 	);`
 
 	sqlCreateCategoryMembers = `
-	CREATE TABLE category_members(
+	CREATE TABLE IF NOT EXISTS category_members(
 		CategoryID bigint(20) NOT NULL,
 		MemberID bigint(20) NOT NULL,
 		
 		FOREIGN KEY (CategoryID) REFERENCES categories(ID),
 		FOREIGN KEY (MemberID) REFERENCES members(ID)
 	);`
+
+	sqlCreatePasswordResets = `
+	CREATE TABLE IF NOT EXISTS password_resets(
+		ID bigint(20) NOT NULL AUTO_INCREMENT,
+		Created bigint(20) NOT NULL,
+		Updated bigint(20) NOT NULL,
+		Deleted tinyint(1) NOT NULL,
+
+		MemberID bigint(20) NOT Null,
+		Hash varchar(255) NOT Null,
+		Expiration bigint(20) NOT NULL,
+		Used tinyint(1) NOT NULL,
+
+		PRIMARY KEY (ID),
+		INDEX (Hash),
+		FOREIGN KEY (MemberID) REFERENCES members(ID)
+	);`
+
+	sqlCreateRegistrations = `
+	CREATE TABLE IF NOT EXISTS registrations(
+		ID bigint(20) NOT NULL AUTO_INCREMENT,
+		Created bigint(20) NOT NULL,
+		Updated bigint(20) NOT NULL,
+		Deleted tinyint(1) NOT NULL,
+
+		Name varchar(255) NOT Null,
+		Email varchar(255) NOT Null,
+		PasswordHash varchar(255) NOT NULL,
+		Status varchar(255) NOT Null,
+		MemberID bigint(20) NOT Null,
+
+		PRIMARY KEY (ID),
+		INDEX (Email)
+	);`
+
+	sqlCreateIdentities = `
+	CREATE TABLE IF NOT EXISTS identities(
+		ID bigint(20) NOT NULL AUTO_INCREMENT,
+		Created bigint(20) NOT NULL,
+		Updated bigint(20) NOT NULL,
+		Deleted tinyint(1) NOT NULL,
+
+		MemberID bigint(20) NOT Null,
+		Provider varchar(255) NOT Null,
+		ProviderID varchar(255) NOT Null,
+		Handle varchar(255) NOT Null,
+
+		PRIMARY KEY (ID),
+		FOREIGN KEY (MemberID) REFERENCES members(ID),
+		UNIQUE (Provider, ProviderID)
+	);`
+
+	sqlCreateAPIKeys = `
+	CREATE TABLE IF NOT EXISTS api_keys(
+		ID bigint(20) NOT NULL AUTO_INCREMENT,
+		Created bigint(20) NOT NULL,
+		Updated bigint(20) NOT NULL,
+		Deleted tinyint(1) NOT NULL,
+
+		Name varchar(255) NOT Null,
+		MemberID bigint(20) NOT Null,
+		Hash varchar(255) NOT Null,
+		ScopesRaw text NOT Null,
+		Expiration bigint(20) NOT NULL,
+
+		PRIMARY KEY (ID),
+		INDEX (Hash),
+		FOREIGN KEY (MemberID) REFERENCES members(ID)
+	);`
+
+	sqlCreateAuditEvents = `
+	CREATE TABLE IF NOT EXISTS audit_events(
+		ID bigint(20) NOT NULL AUTO_INCREMENT,
+		Created bigint(20) NOT NULL,
+		Updated bigint(20) NOT NULL,
+		Deleted tinyint(1) NOT NULL,
+
+		ActorType varchar(255) NOT Null,
+		ActorID bigint(20) NOT Null,
+		Action varchar(255) NOT Null,
+		ResourceTable varchar(255) NOT Null,
+		ResourceID bigint(20) NOT Null,
+		BeforeRaw text NOT Null,
+		AfterRaw text NOT Null,
+
+		PRIMARY KEY (ID),
+		INDEX (ActorType, ActorID),
+		INDEX (ResourceTable, ResourceID),
+		INDEX (Created)
+	);`
+)
+
+var (
+	sqlMigrations = []string{
+		`ALTER TABLE tokens ADD Hash varchar(255) NOT Null DEFAULT ''`,
+		`ALTER TABLE tokens ADD INDEX Hash (Hash)`,
+		`ALTER TABLE communities ADD RegistrationPolicy varchar(255) NOT Null DEFAULT 'closed'`,
+		`ALTER TABLE members ADD FailedLogins bigint(20) NOT NULL DEFAULT 0`,
+		`ALTER TABLE members ADD LastFailedLogin bigint(20) NOT NULL DEFAULT 0`,
+		`ALTER TABLE members ADD LockedUntil bigint(20) NOT NULL DEFAULT 0`,
+		`ALTER TABLE tokens ADD UserAgent varchar(255) NOT Null DEFAULT ''`,
+		`ALTER TABLE tokens ADD IP varchar(255) NOT Null DEFAULT ''`,
+		`ALTER TABLE tokens ADD LastUsed bigint(20) NOT NULL DEFAULT 0`,
+		`ALTER TABLE communities ADD RequireOrganizerTwoFactor tinyint(1) NOT NULL DEFAULT 0`,
+		`ALTER TABLE members ADD TOTPSecret varchar(255) NOT Null DEFAULT ''`,
+		`ALTER TABLE members ADD TOTPEnabled tinyint(1) NOT NULL DEFAULT 0`,
+		`ALTER TABLE members ADD RecoveryCodesRaw text NOT Null`,
+		`ALTER TABLE members ADD TOTPLastStep bigint(20) NOT NULL DEFAULT 0`,
+		`ALTER TABLE members ADD FULLTEXT KEY ftNameDescription (Name, Description)`,
+		`ALTER TABLE stories ADD FULLTEXT KEY ftBody (Body)`,
+	}
 )